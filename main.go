@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -10,6 +11,9 @@ import (
 	"github.com/paragor/simple_cdn/pkg/cachebehavior"
 	"github.com/paragor/simple_cdn/pkg/logger"
 	"github.com/paragor/simple_cdn/pkg/metrics"
+	"github.com/paragor/simple_cdn/pkg/pathnorm"
+	"github.com/paragor/simple_cdn/pkg/route"
+	"github.com/paragor/simple_cdn/pkg/site"
 	"github.com/paragor/simple_cdn/pkg/upstream"
 	"github.com/paragor/simple_cdn/pkg/user"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -60,20 +64,43 @@ func main() {
 	log.With(zap.String("description", config.CanPersistCache.ToUser().String())).Info("can persist cache config")
 	log.With(zap.String("description", config.CanLoadCache.ToUser().String())).Info("can load cache config")
 	log.With(zap.String("description", config.CanForceEmitDebugLogging.ToUser().String())).Info("can force emit debug logging")
+	for _, warning := range config.CacheKeyConfig.Warnings() {
+		log.Warn(warning)
+	}
+	logBehaviorsWarnings(log, config.Behaviors)
+	for i := range config.Sites {
+		siteLog := log.With(zap.String("site", config.Sites[i].Name))
+		for _, warning := range config.Sites[i].CacheKeyConfig.Warnings() {
+			siteLog.Warn(warning)
+		}
+		logBehaviorsWarnings(siteLog, config.Sites[i].Behaviors)
+	}
 	if *checkConfig {
 		log.Info("check-config is set, config is valid")
 		os.Exit(0)
 	}
 
 	cacheDb := config.Cache.Cache()
-	handler := cachebehavior.NewCacheBehavior(
-		config.CanPersistCache.ToUser(),
-		config.CanLoadCache.ToUser(),
-		&config.CacheKeyConfig,
-		config.Upstream.CreateUpstream(),
-		cacheDb,
-		config.OrderedCacheControlFallback.ToCacheControlParser(),
-	)
+	// default site has own namespace, so invalidation without site never touches keys of sites
+	defaultCache := cache.NewNamespace(cacheDb, config.Namespace())
+	defaultSite := route.NewTable(config.Behaviors, &route.Defaults{
+		Name:                        "default",
+		CanPersistCache:             &config.CanPersistCache,
+		CanLoadCache:                &config.CanLoadCache,
+		CacheKeyConfig:              &config.CacheKeyConfig,
+		Upstream:                    config.Upstream.CreateUpstream("default"),
+		OrderedCacheControlFallback: &config.OrderedCacheControlFallback,
+		CacheBehavior:               &config.CacheBehavior,
+	}, defaultCache)
+	sitesCache := map[string]cache.Cache{}
+	router := site.NewRouter(defaultSite)
+	for i := range config.Sites {
+		siteConfig := &config.Sites[i]
+		router.Add(siteConfig, siteConfig.Handler(cacheDb))
+		sitesCache[siteConfig.Name] = siteConfig.Cache(cacheDb)
+	}
+	var handler http.Handler = router
+	handler = config.PathNormalization.Middleware(handler)
 	handler = logger.HttpRecoveryMiddleware(handler)
 	handler = logger.HttpLoggingMiddleware(handler)
 	handler = logger.HttpSetLoggerMiddleware(config.CanForceEmitDebugLogging.ToUser(), handler)
@@ -84,7 +111,7 @@ func main() {
 	}
 	diagnosticServer := http.Server{
 		Addr:    config.DiagnosticAddr,
-		Handler: GetDiagnosticServerHandler(cacheDb),
+		Handler: GetDiagnosticServerHandler(defaultCache, sitesCache),
 	}
 
 	diagnosticServer.RegisterOnShutdown(func() {
@@ -113,16 +140,44 @@ func main() {
 	log.Info("good bye")
 }
 
+// logBehaviorsWarnings logs warnings of cache key configs overridden by behaviors
+func logBehaviorsWarnings(log *zap.Logger, behaviors []route.Config) {
+	for i := range behaviors {
+		if behaviors[i].CacheKeyConfig == nil {
+			continue
+		}
+		for _, warning := range behaviors[i].CacheKeyConfig.Warnings() {
+			log.With(zap.String("behavior", behaviors[i].Name)).Warn(warning)
+		}
+	}
+}
+
 type Config struct {
 	ListenAddr                  string                                          `yaml:"listen_addr"`
 	DiagnosticAddr              string                                          `yaml:"diagnostic_addr"`
 	CanPersistCache             user.Config                                     `yaml:"can_persist_cache"`
 	CanLoadCache                user.Config                                     `yaml:"can_load_cache"`
 	CanForceEmitDebugLogging    user.Config                                     `yaml:"can_force_emit_debug_logging"`
+	PathNormalization           pathnorm.Config                                 `yaml:"path_normalization"`
 	CacheKeyConfig              cache.KeyConfig                                 `yaml:"cache_key_config"`
 	Upstream                    upstream.Config                                 `yaml:"upstream"`
 	Cache                       cache.Config                                    `yaml:"cache"`
 	OrderedCacheControlFallback cachebehavior.OrderedCacheControlFallbackConfig `yaml:"ordered_cache_control_fallback"`
+	CacheBehavior               cachebehavior.Config                            `yaml:"cache_behavior"`
+	// Behaviors - ordered list of behaviors of default site paths, first matched is used
+	Behaviors []route.Config `yaml:"behaviors"`
+	// Sites - virtual hosts, requests of unmatched hosts are served by top-level config (default site)
+	Sites []site.Config `yaml:"sites"`
+	// CacheNamespace - prefix of cache keys of default site, default is "default"
+	CacheNamespace string `yaml:"cache_namespace"`
+}
+
+// Namespace returns prefix of default site cache keys
+func (c *Config) Namespace() string {
+	if c.CacheNamespace == "" {
+		return "default"
+	}
+	return c.CacheNamespace
 }
 
 func (c *Config) Validate() error {
@@ -141,6 +196,9 @@ func (c *Config) Validate() error {
 	if err := c.CanLoadCache.Validate(); err != nil {
 		return fmt.Errorf("can_load_cache invalid: %w", err)
 	}
+	if err := c.PathNormalization.Validate(); err != nil {
+		return fmt.Errorf("path_normalization invalid: %w", err)
+	}
 	if err := c.CacheKeyConfig.Validate(); err != nil {
 		return fmt.Errorf("cache_key_config invalid: %w", err)
 	}
@@ -153,6 +211,31 @@ func (c *Config) Validate() error {
 	if err := c.OrderedCacheControlFallback.Validate(); err != nil {
 		return fmt.Errorf("ordered_cache_control_fallback invalid: %w", err)
 	}
+	if err := c.CacheBehavior.Validate(); err != nil {
+		return fmt.Errorf("cache_behavior invalid: %w", err)
+	}
+	if err := route.ValidateList(c.Behaviors); err != nil {
+		return fmt.Errorf("behaviors: %w", err)
+	}
+	if err := site.ValidateNamespace(c.Namespace()); err != nil {
+		return fmt.Errorf("cache_namespace %w", err)
+	}
+	names := map[string]struct{}{}
+	namespaces := map[string]struct{}{c.Namespace(): {}}
+	for i := range c.Sites {
+		siteConfig := &c.Sites[i]
+		if err := siteConfig.Validate(); err != nil {
+			return fmt.Errorf("sites: %d invalid: %w", i, err)
+		}
+		if _, exists := names[siteConfig.Name]; exists {
+			return fmt.Errorf("sites: %d invalid: duplicate name %s", i, siteConfig.Name)
+		}
+		names[siteConfig.Name] = struct{}{}
+		if _, exists := namespaces[siteConfig.Namespace()]; exists {
+			return fmt.Errorf("sites: %d invalid: duplicate cache namespace %s", i, siteConfig.Namespace())
+		}
+		namespaces[siteConfig.Namespace()] = struct{}{}
+	}
 	return nil
 }
 
@@ -169,7 +252,7 @@ func ParseConfig(data []byte) (*Config, error) {
 	return config, nil
 }
 
-func GetDiagnosticServerHandler(cacheDb cache.Cache) http.Handler {
+func GetDiagnosticServerHandler(defaultCache cache.Cache, sitesCache map[string]cache.Cache) http.Handler {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/readyz", func(writer http.ResponseWriter, request *http.Request) {
 		writer.WriteHeader(200)
@@ -191,13 +274,25 @@ func GetDiagnosticServerHandler(cacheDb cache.Cache) http.Handler {
 			http.Error(writer, "query 'pattern' is empty", 400)
 			return
 		}
-		if err := cacheDb.Invalidate(ctx, keyPattern); err != nil {
+		siteCache := defaultCache
+		if siteName := request.URL.Query().Get("site"); siteName != "" {
+			var exists bool
+			if siteCache, exists = sitesCache[siteName]; !exists {
+				http.Error(writer, "site '"+siteName+"' is not found", 404)
+				return
+			}
+		}
+		if err := siteCache.Invalidate(ctx, keyPattern); err != nil {
 			http.Error(writer, "cant invalidate cache:"+err.Error(), 500)
 		}
 
 		writer.WriteHeader(200)
 		_, _ = writer.Write([]byte("ok"))
 	})
+	mux.HandleFunc("/upstreams", func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(writer).Encode(upstream.Health())
+	})
 	mux.Handle("/metrics", promhttp.Handler())
 	mux.HandleFunc("/debug/pprof/", pprof.Index)
 	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
@@ -3,6 +3,7 @@ package cache
 import (
 	"context"
 	"fmt"
+	"time"
 )
 
 type Config struct {
@@ -27,8 +28,41 @@ func (c *Config) Cache() Cache {
 	panic("only redis is supported")
 }
 
+type WriteMode int
+
+const (
+	// WriteInsert saves item only if key is absent
+	WriteInsert WriteMode = iota
+	// WriteOverwrite always saves item
+	WriteOverwrite
+	// WriteCompareAndSwap saves item if key is absent or stored item is older (by SavedAt)
+	WriteCompareAndSwap
+)
+
+func (m WriteMode) String() string {
+	switch m {
+	case WriteInsert:
+		return "insert"
+	case WriteOverwrite:
+		return "overwrite"
+	case WriteCompareAndSwap:
+		return "cas"
+	}
+	return "unknown"
+}
+
 type Cache interface {
 	Get(ctx context.Context, key string) *Item
-	Set(ctx context.Context, key string, value *Item)
+	Set(ctx context.Context, key string, value *Item, mode WriteMode)
+	// Refresh replaces metadata of stored item if it is still the revalidated one (saved at revalidatedSavedAt),
+	// stored body is kept as is
+	Refresh(ctx context.Context, key string, value *Item, revalidatedSavedAt time.Time)
+	// GetEncoded returns body encoded by content coding of stored item if it is still the one saved at savedAt.
+	// Get returns item without encoded bodies which are not stored as body, so they are fetched on demand
+	GetEncoded(ctx context.Context, key string, savedAt time.Time, encoding string) []byte
+	// SetEncoded adds body encoded by content coding to stored item if it is still the one saved at savedAt
+	SetEncoded(ctx context.Context, key string, savedAt time.Time, encoding string, body []byte)
 	Invalidate(ctx context.Context, keyPattern string) error
+	// TryLock takes short-lived lock of key shared between replicas, unlock should be called by lock holder
+	TryLock(ctx context.Context, key string, ttl time.Duration) (unlock func(), acquired bool, err error)
 }
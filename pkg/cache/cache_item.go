@@ -1,7 +1,12 @@
 package cache
 
 import (
+	"bytes"
+	"github.com/paragor/simple_cdn/pkg/compression"
+	"math"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -10,7 +15,27 @@ type Item struct {
 	SavedAt     time.Time
 	CacheHeader CacheControl
 	Headers     map[string][]string
-	Body        []byte
+	Body        []byte `json:"-"`
+	// Encoded - body encoded by content codings, it is optional
+	Encoded map[string][]byte `json:"-"`
+	// FetchDuration - how long upstream took to answer, used for early refresh
+	FetchDuration time.Duration
+	// Vary - item is only pointer to variants stored by keys from values of these request headers
+	Vary []string `json:",omitempty"`
+}
+
+// HasVariants returns true if item is pointer to variants, see KeyConfig.ApplyVary
+func (item *Item) HasVariants() bool {
+	return len(item.Vary) > 0
+}
+
+// VariantsPointer returns item which is stored by primary key instead of variant item
+func (item *Item) VariantsPointer(vary []string) *Item {
+	return &Item{
+		SavedAt:     item.SavedAt,
+		CacheHeader: item.CacheHeader,
+		Vary:        vary,
+	}
 }
 
 func (item *Item) CanUseCache(now time.Time) bool {
@@ -25,6 +50,16 @@ func (item *Item) CanStaleWhileRevalidation(now time.Time) bool {
 	return item.CacheHeader.Public && now.Sub(item.SavedAt) < item.CacheHeader.StaleWhileRevalidate
 }
 
+// ShouldRefreshEarly decides if fresh item should be refreshed before s-maxage (XFetch),
+// chance grows as item nears s-maxage, random should be in (0, 1]
+func (item *Item) ShouldRefreshEarly(now time.Time, beta float64, random float64) bool {
+	if !item.CanUseCache(now) || item.FetchDuration <= 0 {
+		return false
+	}
+	gap := time.Duration(float64(item.FetchDuration) * beta * -math.Log(random))
+	return !now.Add(gap).Before(item.SavedAt.Add(item.CacheHeader.SMaxAge))
+}
+
 func ItemFromResponse(response *http.Response, cacheControl CacheControl, body []byte) *Item {
 	if !cacheControl.ShouldCDNPersist() {
 		return nil
@@ -37,17 +72,110 @@ func ItemFromResponse(response *http.Response, cacheControl CacheControl, body [
 	}
 }
 
+// conditionalRequestHeaders could turn upstream response into 304 or 412
+var conditionalRequestHeaders = []string{
+	"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range",
+}
+
+// SetValidators replaces conditional headers of request with validators of stored item.
+// Returns false if item have no validators.
+func (item *Item) SetValidators(header http.Header) bool {
+	stored := http.Header(item.Headers)
+	etag := stored.Get("ETag")
+	lastModified := stored.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		return false
+	}
+	for _, h := range conditionalRequestHeaders {
+		header.Del(h)
+	}
+	if etag != "" {
+		header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		header.Set("If-Modified-Since", lastModified)
+	}
+	return true
+}
+
+// MergeHeaders returns stored headers updated with headers of 304 response (rfc9111 section 4.3.4)
+func (item *Item) MergeHeaders(notModified http.Header) http.Header {
+	headers := http.Header(item.Headers).Clone()
+	if headers == nil {
+		headers = http.Header{}
+	}
+	for k, values := range notModified {
+		lowerHeader := strings.ToLower(k)
+		if lowerHeader == "content-length" || lowerHeader == "x-cache-status" || lowerHeader == "x-upstream-failover" {
+			continue
+		}
+		headers[k] = append([]string(nil), values...)
+	}
+	return headers
+}
+
+// Revalidated returns fresh copy of item, body is shared with original item
+func (item *Item) Revalidated(headers http.Header, cacheControl CacheControl) *Item {
+	return &Item{
+		SavedAt:     time.Now(),
+		Headers:     headers,
+		Body:        item.Body,
+		Encoded:     item.Encoded,
+		CacheHeader: cacheControl,
+	}
+}
+
 func (item *Item) Write(w http.ResponseWriter) error {
+	item.writeHeaders(w)
+	w.WriteHeader(200)
+	_, err := w.Write(item.Body)
+	return err
+}
+
+// Serve writes item as response to request, range requests are answered with 206 or 416,
+// HEAD requests are answered without body
+func (item *Item) Serve(w http.ResponseWriter, r *http.Request) error {
+	if r.Header.Get("Range") == "" && r.Method == http.MethodHead {
+		item.writeHeaders(w, "content-length")
+		w.Header().Set("Content-Length", strconv.Itoa(len(item.Body)))
+		w.WriteHeader(200)
+		return nil
+	}
+	if r.Header.Get("Range") == "" {
+		return item.Write(w)
+	}
+	item.writeHeaders(w, "content-length", "content-range")
+	modTime, err := http.ParseTime(http.Header(item.Headers).Get("Last-Modified"))
+	if err != nil {
+		modTime = time.Time{}
+	}
+	http.ServeContent(w, r, "", modTime, bytes.NewReader(item.Body))
+	return nil
+}
+
+// ServeEncoded writes item as response with body encoded by content coding, HEAD requests are answered without body
+func (item *Item) ServeEncoded(w http.ResponseWriter, r *http.Request, encoding string, encodedBody []byte) error {
+	item.writeHeaders(w, "content-length")
+	compression.SetHeaders(w.Header(), encoding)
+	w.Header().Set("Content-Length", strconv.Itoa(len(encodedBody)))
+	w.WriteHeader(200)
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	_, err := w.Write(encodedBody)
+	return err
+}
+
+func (item *Item) writeHeaders(w http.ResponseWriter, skipHeaders ...string) {
 	for k, values := range item.Headers {
 		lowerHeader := strings.ToLower(k)
-		if lowerHeader == "x-cache-status" || lowerHeader == "set-cookie" {
+		// failover of upstream is not a property of cached item
+		if lowerHeader == "x-cache-status" || lowerHeader == "set-cookie" || lowerHeader == "x-upstream-failover" ||
+			slices.Contains(skipHeaders, lowerHeader) {
 			continue
 		}
 		for _, v := range values {
 			w.Header().Add(k, v)
 		}
 	}
-	w.WriteHeader(200)
-	_, err := w.Write(item.Body)
-	return err
 }
@@ -0,0 +1,93 @@
+package cache
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestItem_ShouldRefreshEarly(t *testing.T) {
+	now := time.Now()
+	cacheControl := CacheControl{Public: true, SMaxAge: time.Minute}
+	tests := []struct {
+		name   string
+		item   Item
+		beta   float64
+		random float64
+		want   bool
+	}{
+		{
+			name:   "far from expiration",
+			item:   Item{SavedAt: now.Add(-10 * time.Second), CacheHeader: cacheControl, FetchDuration: time.Second},
+			beta:   1,
+			random: 0.5,
+			want:   false,
+		},
+		{
+			name:   "near expiration",
+			item:   Item{SavedAt: now.Add(-59 * time.Second), CacheHeader: cacheControl, FetchDuration: time.Second},
+			beta:   1,
+			random: 0.1,
+			want:   true,
+		},
+		{
+			name:   "near expiration, lucky random",
+			item:   Item{SavedAt: now.Add(-59 * time.Second), CacheHeader: cacheControl, FetchDuration: time.Second},
+			beta:   1,
+			random: 1,
+			want:   false,
+		},
+		{
+			name:   "big beta",
+			item:   Item{SavedAt: now.Add(-30 * time.Second), CacheHeader: cacheControl, FetchDuration: time.Second},
+			beta:   100,
+			random: 0.5,
+			want:   true,
+		},
+		{
+			name:   "unknown fetch duration",
+			item:   Item{SavedAt: now.Add(-59 * time.Second), CacheHeader: cacheControl},
+			beta:   1,
+			random: 0.1,
+			want:   false,
+		},
+		{
+			name:   "expired",
+			item:   Item{SavedAt: now.Add(-2 * time.Minute), CacheHeader: cacheControl, FetchDuration: time.Second},
+			beta:   1,
+			random: 0.1,
+			want:   false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.item.ShouldRefreshEarly(now, tt.beta, tt.random); got != tt.want {
+				t.Errorf("ShouldRefreshEarly() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestItem_Write(t *testing.T) {
+	item := &Item{
+		Headers: map[string][]string{
+			"Content-Type":        {"text/plain"},
+			"X-Cache-Status":      {"MISS"},
+			"Set-Cookie":          {"session=1"},
+			"X-Upstream-Failover": {"1"},
+		},
+		Body: []byte("body"),
+	}
+	recorder := httptest.NewRecorder()
+	if err := item.Write(recorder); err != nil {
+		t.Fatal(err)
+	}
+	if got := recorder.Header().Get("Content-Type"); got != "text/plain" {
+		t.Errorf("Content-Type = %q, want text/plain", got)
+	}
+	for _, header := range []string{"X-Cache-Status", "Set-Cookie", "X-Upstream-Failover"} {
+		if got := recorder.Header().Get(header); got != "" {
+			t.Errorf("%s = %q, want it skipped", header, got)
+		}
+	}
+}
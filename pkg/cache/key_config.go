@@ -4,8 +4,10 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"fmt"
+	"github.com/paragor/simple_cdn/pkg/user"
 	"hash"
 	"net/http"
+	"regexp"
 	"sort"
 	"strings"
 	"sync"
@@ -25,6 +27,32 @@ type KeyConfig struct {
 	AllQuery   bool `yaml:"all_query"`
 	AllHeaders bool `yaml:"all_headers"`
 
+	// IgnoreQueryPatterns - query params matched by glob patterns (only * is special) are not in key
+	IgnoreQueryPatterns []string `yaml:"ignore_query_patterns,omitempty"`
+	// QueryCaseInsensitive - values of query params are lowercased
+	QueryCaseInsensitive bool `yaml:"query_case_insensitive"`
+	// SortQueryValues - repeated query params are sorted, so ?a=2&a=1 is the same as ?a=1&a=2
+	SortQueryValues bool `yaml:"sort_query_values"`
+	// DropEmptyQuery - query params with empty values are not in key
+	DropEmptyQuery bool `yaml:"drop_empty_query"`
+
+	// Template - format of key with placeholders {method}, {scheme}, {host}, {path}, {query}, {vary} and {hash}, default is {path}|{hash}.
+	// {vary} is readable headers, cookies and variants of key, so {hash} could be omitted if both {query} and {vary} are used
+	Template string `yaml:"template"`
+	// Hash - hash of headers, query, cookies and variants in key: md5 (default), sha256 or xxhash
+	Hash string `yaml:"hash"`
+	// ReadableKey - raw key is used instead of hash, for debugging
+	ReadableKey bool `yaml:"readable_key"`
+
+	// HeaderNormalizers - values of headers in key are reduced by normalizers, map key is header name
+	HeaderNormalizers map[string]HeaderNormalizerConfig `yaml:"header_normalizers,omitempty"`
+	// Variants - named dimensions, name of first matched variant of each dimension is in key
+	Variants map[string][]KeyVariantConfig `yaml:"variants,omitempty"`
+
+	templateParts []keyTemplatePart
+	variants      []keyDimension
+	normalizers   map[string]headerNormalizer
+	ignoreQuery   []*regexp.Regexp
 	notHeadersMap map[string]struct{}
 	headersMap    map[string]struct{}
 	cookiesMap    map[string]struct{}
@@ -33,6 +61,21 @@ type KeyConfig struct {
 	compiled      atomic.Bool
 }
 
+type KeyVariantConfig struct {
+	Name string      `yaml:"name"`
+	User user.Config `yaml:"user"`
+}
+
+type keyDimension struct {
+	name     string
+	variants []keyVariant
+}
+
+type keyVariant struct {
+	name string
+	user user.User
+}
+
 func (kc *KeyConfig) Validate() error {
 	if len(kc.Headers) > 0 && kc.AllHeaders {
 		return fmt.Errorf("only on of two field must be specified: headers, all_headers")
@@ -43,9 +86,54 @@ func (kc *KeyConfig) Validate() error {
 	if len(kc.Query) > 0 && kc.AllQuery {
 		return fmt.Errorf("only on of two field must be specified: query, all_query")
 	}
+	if err := kc.validateTemplate(); err != nil {
+		return err
+	}
+	for header, normalizer := range kc.HeaderNormalizers {
+		if err := normalizer.Validate(); err != nil {
+			return fmt.Errorf("header_normalizers: %s: %w", header, err)
+		}
+		if !kc.isKeyHeader(header) {
+			return fmt.Errorf("header_normalizers: %s: header is not in key", header)
+		}
+	}
+	for dimension, variants := range kc.Variants {
+		if dimension == "" {
+			return fmt.Errorf("variants: dimension name is empty")
+		}
+		if len(variants) == 0 {
+			return fmt.Errorf("variants: %s: variants are empty", dimension)
+		}
+		for i, variant := range variants {
+			if variant.Name == "" {
+				return fmt.Errorf("variants: %s: %d: name is empty", dimension, i)
+			}
+			if err := variant.User.Validate(); err != nil {
+				return fmt.Errorf("variants: %s: %s: user invalid: %w", dimension, variant.Name, err)
+			}
+		}
+	}
 	return nil
 }
 
+// isKeyHeader checks header name by config the same way as keyHeaders, so it could be used before compile
+func (kc *KeyConfig) isKeyHeader(header string) bool {
+	if len(kc.Headers) == 0 && !kc.AllHeaders {
+		return false
+	}
+	if kc.AllHeaders && !isBlacklistHeader(header) {
+		return true
+	}
+	for _, headers := range [][]string{kc.Headers, kc.NotHeaders} {
+		for _, k := range headers {
+			if strings.EqualFold(k, header) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (kc *KeyConfig) compile() {
 	if kc.compiled.Load() {
 		return
@@ -60,6 +148,27 @@ func (kc *KeyConfig) compile() {
 	kc.cookiesMap = make(map[string]struct{})
 	kc.queryMap = make(map[string]struct{})
 	kc.notHeadersMap = make(map[string]struct{})
+	kc.ignoreQuery = make([]*regexp.Regexp, 0, len(kc.IgnoreQueryPatterns))
+	for _, pattern := range kc.IgnoreQueryPatterns {
+		kc.ignoreQuery = append(kc.ignoreQuery, globToRegexp(pattern))
+	}
+	templateParts, err := parseKeyTemplate(kc.template())
+	if err != nil {
+		templateParts, _ = parseKeyTemplate(defaultKeyTemplate)
+	}
+	kc.templateParts = templateParts
+	kc.normalizers = make(map[string]headerNormalizer, len(kc.HeaderNormalizers))
+	for header, normalizer := range kc.HeaderNormalizers {
+		kc.normalizers[strings.ToLower(header)] = normalizer.toNormalizer()
+	}
+	kc.variants = make([]keyDimension, 0, len(kc.Variants))
+	for _, dimension := range sortedKeys(kc.Variants) {
+		compiled := keyDimension{name: dimension}
+		for _, variant := range kc.Variants[dimension] {
+			compiled.variants = append(compiled.variants, keyVariant{name: variant.Name, user: variant.User.ToUser()})
+		}
+		kc.variants = append(kc.variants, compiled)
+	}
 
 	for _, k := range kc.NotHeaders {
 		kc.notHeadersMap[strings.ToLower(k)] = struct{}{}
@@ -96,46 +205,142 @@ func (kc *KeyConfig) generateRawKeyForHash(r *http.Request) string {
 	key := &strings.Builder{}
 	key.Grow(512)
 	key.WriteString("headers" + keySpecDelimiter)
-	if len(kc.Headers) > 0 || kc.AllHeaders {
-		headersMap := make(map[string]string, len(r.Header))
-		for k := range r.Header {
-			_, inAllowList := kc.headersMap[strings.ToLower(k)]
-			_, inBlackList := kc.notHeadersMap[strings.ToLower(k)]
-			if !inBlackList && !inAllowList && !(kc.AllHeaders && !isBlacklistHeader(k)) {
-				continue
-			}
-			headersMap[k] = strings.Join(r.Header[k], keySpecDelimiter) // not sortable :(
-		}
-		kc.addMapToKey(key, headersMap)
-	}
+	kc.addMapToKey(key, kc.keyHeaders(r))
 	key.WriteString(keySpecDelimiter + "query" + keySpecDelimiter)
 	if len(kc.queryMap) > 0 || kc.AllQuery {
 		query := r.URL.Query()
 		queryMap := make(map[string]string, len(query))
 		for k := range query {
-			if _, exists := kc.queryMap[k]; kc.AllQuery || exists {
-				queryMap[k] = strings.Join(query[k], keySpecDelimiter) // not sortable :(
+			if _, exists := kc.queryMap[k]; !kc.AllQuery && !exists {
+				continue
+			}
+			if kc.isIgnoredQuery(k) {
+				continue
+			}
+			if values := kc.normalizeQueryValues(query[k]); len(values) > 0 {
+				queryMap[k] = strings.Join(values, keySpecDelimiter)
 			}
 		}
 		kc.addMapToKey(key, queryMap)
 	}
 	key.WriteString(keySpecDelimiter + "cookies" + keySpecDelimiter)
-	if len(kc.cookiesMap) > 0 || kc.AllCookies {
-		cookies := r.Cookies()
-		cookiesMap := make(map[string]string, len(cookies))
-		for _, cookie := range cookies {
-			if err := cookie.Valid(); err != nil {
-				continue
-			}
-			if _, exists := kc.cookiesMap[cookie.Name]; kc.AllCookies || exists {
-				cookiesMap[cookie.Name] = cookie.Value
+	kc.addMapToKey(key, kc.keyCookies(r))
+	// keys without variants are the same as before variants were introduced
+	if len(kc.variants) > 0 {
+		key.WriteString(keySpecDelimiter + "variants" + keySpecDelimiter)
+		for i, dimension := range kc.variants {
+			key.WriteString(dimension.name + "=" + dimension.match(r))
+			if i != len(kc.variants)-1 {
+				key.WriteString(keySpecDelimiter)
 			}
 		}
-		kc.addMapToKey(key, cookiesMap)
 	}
 	return key.String()
 }
 
+// keyHeaders returns normalized headers which are in key
+func (kc *KeyConfig) keyHeaders(r *http.Request) map[string]string {
+	if len(kc.Headers) == 0 && !kc.AllHeaders {
+		return nil
+	}
+	headersMap := make(map[string]string, len(r.Header))
+	for k := range r.Header {
+		_, inAllowList := kc.headersMap[strings.ToLower(k)]
+		_, inBlackList := kc.notHeadersMap[strings.ToLower(k)]
+		if !inBlackList && !inAllowList && !(kc.AllHeaders && !isBlacklistHeader(k)) {
+			continue
+		}
+		if normalizer, ok := kc.normalizers[strings.ToLower(k)]; ok {
+			headersMap[k] = normalizer.normalize(strings.Join(r.Header[k], ","))
+			continue
+		}
+		headersMap[k] = strings.Join(r.Header[k], keySpecDelimiter) // not sortable :(
+	}
+	return headersMap
+}
+
+// keyCookies returns valid cookies which are in key
+func (kc *KeyConfig) keyCookies(r *http.Request) map[string]string {
+	if len(kc.cookiesMap) == 0 && !kc.AllCookies {
+		return nil
+	}
+	cookies := r.Cookies()
+	cookiesMap := make(map[string]string, len(cookies))
+	for _, cookie := range cookies {
+		if err := cookie.Valid(); err != nil {
+			continue
+		}
+		if _, exists := kc.cookiesMap[cookie.Name]; kc.AllCookies || exists {
+			cookiesMap[cookie.Name] = cookie.Value
+		}
+	}
+	return cookiesMap
+}
+
+// match returns name of first matched variant, empty string if nothing is matched
+func (d *keyDimension) match(r *http.Request) string {
+	for _, variant := range d.variants {
+		if variant.user.IsUser(r) {
+			return variant.name
+		}
+	}
+	return ""
+}
+
+// keyQuery returns normalized query params which are in key
+func (kc *KeyConfig) keyQuery(r *http.Request) map[string][]string {
+	if len(kc.queryMap) == 0 && !kc.AllQuery {
+		return nil
+	}
+	query := r.URL.Query()
+	result := make(map[string][]string, len(query))
+	for k := range query {
+		if _, exists := kc.queryMap[k]; !kc.AllQuery && !exists {
+			continue
+		}
+		if kc.isIgnoredQuery(k) {
+			continue
+		}
+		if values := kc.normalizeQueryValues(query[k]); len(values) > 0 {
+			result[k] = values
+		}
+	}
+	return result
+}
+
+func (kc *KeyConfig) isIgnoredQuery(name string) bool {
+	for _, re := range kc.ignoreQuery {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (kc *KeyConfig) normalizeQueryValues(values []string) []string {
+	if !kc.QueryCaseInsensitive && !kc.SortQueryValues && !kc.DropEmptyQuery {
+		return values // not sortable :(
+	}
+	normalized := make([]string, 0, len(values))
+	for _, value := range values {
+		if kc.DropEmptyQuery && value == "" {
+			continue
+		}
+		if kc.QueryCaseInsensitive {
+			value = strings.ToLower(value)
+		}
+		normalized = append(normalized, value)
+	}
+	if kc.SortQueryValues {
+		sort.Strings(normalized)
+	}
+	return normalized
+}
+
+func globToRegexp(pattern string) *regexp.Regexp {
+	return regexp.MustCompile("^" + strings.ReplaceAll(regexp.QuoteMeta(pattern), "\\*", ".*") + "$")
+}
+
 func (kc *KeyConfig) addMapToKey(key *strings.Builder, addMap map[string]string) {
 	lenMap := len(addMap)
 	for i, k := range sortedKeys(addMap) {
@@ -147,7 +352,44 @@ func (kc *KeyConfig) addMapToKey(key *strings.Builder, addMap map[string]string)
 }
 
 func (kc *KeyConfig) Apply(r *http.Request) string {
-	return r.URL.Path + "|" + getMD5Hash(kc.generateRawKeyForHash(r))
+	kc.compile()
+	return kc.renderKey(r)
+}
+
+// ApplyVary returns key of item variant by values of request headers listed in Vary response header,
+// values are reduced by header normalizers as in key
+func (kc *KeyConfig) ApplyVary(primaryKey string, r *http.Request, vary []string) string {
+	kc.compile()
+	key := &strings.Builder{}
+	for i, header := range vary {
+		values := r.Header.Values(header)
+		if normalizer, ok := kc.normalizers[strings.ToLower(header)]; ok && len(values) > 0 {
+			key.WriteString(header + "=" + normalizer.normalize(strings.Join(values, ",")))
+		} else {
+			key.WriteString(header + "=" + strings.Join(values, keySpecDelimiter))
+		}
+		if i != len(vary)-1 {
+			key.WriteString(keySpecDelimiter)
+		}
+	}
+	return primaryKey + "#" + kc.hash()(key.String())
+}
+
+// ParseVary returns sorted lowercase header names of Vary response header
+func ParseVary(header http.Header) []string {
+	varyMap := map[string]struct{}{}
+	for _, value := range header.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name != "" {
+				varyMap[name] = struct{}{}
+			}
+		}
+	}
+	if len(varyMap) == 0 {
+		return nil
+	}
+	return sortedKeys(varyMap)
 }
 
 var notCachableHttpHeadersSource = map[string][]string{
@@ -161,6 +403,7 @@ var notCachableHttpHeadersSource = map[string][]string{
 	"content negotiation":   {"accept-encoding"},
 	"controls":              {"max-forwards"},
 	"proxies":               {"forwarded", "via"},
+	"range requests":        {"range", "if-range"},
 	"other":                 {"upgrade"},
 
 	//https://en.wikipedia.org/wiki/list_of_http_header_fields
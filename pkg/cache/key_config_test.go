@@ -1,7 +1,9 @@
 package cache
 
 import (
+	"gopkg.in/yaml.v3"
 	"net/http"
+	"slices"
 	"testing"
 	"time"
 )
@@ -15,6 +17,11 @@ func TestKeyConfig_generateRawKeyForHash(t *testing.T) {
 		AllCookies bool
 		AllQuery   bool
 		AllHeaders bool
+
+		IgnoreQueryPatterns  []string
+		QueryCaseInsensitive bool
+		SortQueryValues      bool
+		DropEmptyQuery       bool
 	}
 	type args struct {
 		r *http.Request
@@ -101,6 +108,40 @@ func TestKeyConfig_generateRawKeyForHash(t *testing.T) {
 			},
 			want: "headers|Host=www.google.com|query|0_one=two|1_three=|cookies|",
 		},
+		{
+			name: "query normalization",
+			fields: fields{
+				AllQuery:             true,
+				IgnoreQueryPatterns:  []string{"utm_*", "gclid", "fbclid"},
+				QueryCaseInsensitive: true,
+				SortQueryValues:      true,
+				DropEmptyQuery:       true,
+			},
+			args: args{
+				r: createRequest(
+					"utm_source=google&utm_medium=cpc&gclid=123&a=B&a=a&empty=&b=1&xgclid=1&utm=2",
+					nil,
+					nil,
+				),
+			},
+			want: "headers||query|a=a|b|b=1|utm=2|xgclid=1|cookies|",
+		},
+		{
+			name: "query normalization with allow list",
+			fields: fields{
+				Query:               []string{"a", "utm_source"},
+				IgnoreQueryPatterns: []string{"utm_*"},
+				SortQueryValues:     true,
+			},
+			args: args{
+				r: createRequest(
+					"utm_source=google&a=B&a=a&a=&b=1",
+					nil,
+					nil,
+				),
+			},
+			want: "headers||query|a=|B|a|cookies|",
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -112,6 +153,11 @@ func TestKeyConfig_generateRawKeyForHash(t *testing.T) {
 				AllCookies: tt.fields.AllCookies,
 				AllQuery:   tt.fields.AllQuery,
 				AllHeaders: tt.fields.AllHeaders,
+
+				IgnoreQueryPatterns:  tt.fields.IgnoreQueryPatterns,
+				QueryCaseInsensitive: tt.fields.QueryCaseInsensitive,
+				SortQueryValues:      tt.fields.SortQueryValues,
+				DropEmptyQuery:       tt.fields.DropEmptyQuery,
 			}
 			if got := kc.generateRawKeyForHash(tt.args.r); got != tt.want {
 				t.Errorf("generateRawKeyForHash() = %v, want %v", got, tt.want)
@@ -120,6 +166,86 @@ func TestKeyConfig_generateRawKeyForHash(t *testing.T) {
 	}
 }
 
+func TestKeyConfig_variants(t *testing.T) {
+	config := `
+variants:
+  device:
+    - name: mobile
+      user:
+        user_agent:
+          pattern: "(?i)mobile|android"
+    - name: desktop
+      user:
+        always: true
+  beta:
+    - name: "on"
+      user:
+        cookie:
+          exists: beta
+`
+	kc := &KeyConfig{}
+	if err := yaml.Unmarshal([]byte(config), kc); err != nil {
+		t.Fatalf("yaml.Unmarshal() error = %v", err)
+	}
+	if err := kc.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	tests := []struct {
+		name    string
+		header  http.Header
+		cookies []http.Cookie
+		want    string
+	}{
+		{
+			name:   "mobile",
+			header: http.Header{"User-Agent": {"Mozilla/5.0 (Linux; Android 14) Mobile Safari/537.36"}},
+			want:   "headers||query||cookies||variants|beta=|device=mobile",
+		},
+		{
+			name:    "desktop with beta",
+			header:  http.Header{"User-Agent": {"Mozilla/5.0 (X11; Linux x86_64) Chrome/120.0"}},
+			cookies: []http.Cookie{{Name: "beta", Value: "1"}},
+			want:    "headers||query||cookies||variants|beta=on|device=desktop",
+		},
+		{
+			name:   "other desktop version has the same key",
+			header: http.Header{"User-Agent": {"Mozilla/5.0 (X11; Linux x86_64) Chrome/121.0"}},
+			want:   "headers||query||cookies||variants|beta=|device=desktop",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := kc.generateRawKeyForHash(createRequest("", tt.header, tt.cookies)); got != tt.want {
+				t.Errorf("generateRawKeyForHash() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseVary(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   []string
+	}{
+		{name: "empty", header: http.Header{}, want: nil},
+		{name: "one", header: http.Header{"Vary": {"Accept-Language"}}, want: []string{"accept-language"}},
+		{
+			name:   "many values and duplicates",
+			header: http.Header{"Vary": {"Cookie, accept-language", " Accept-Language ,Accept-Encoding,"}},
+			want:   []string{"accept-encoding", "accept-language", "cookie"},
+		},
+		{name: "star", header: http.Header{"Vary": {"*"}}, want: []string{"*"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseVary(tt.header); !slices.Equal(got, tt.want) {
+				t.Errorf("ParseVary() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
 func createRequest(query string, header http.Header, cookies []http.Cookie) *http.Request {
 	request, err := http.NewRequest("GET", "http://127.0.0.1/?"+query, nil)
 	if err != nil {
@@ -136,3 +262,97 @@ func createRequest(query string, header http.Header, cookies []http.Cookie) *htt
 	}
 	return request
 }
+
+func TestKeyConfig_Apply(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		host   string
+		config *KeyConfig
+		want   string
+	}{
+		{
+			name:   "default template",
+			config: &KeyConfig{},
+			want:   "/static/app.js|" + getMD5Hash("headers||query||cookies|"),
+		},
+		{
+			name:   "template with host and query",
+			config: &KeyConfig{Template: "{path}|{method}|{scheme}://{host}?{query}|{hash}", Hash: KeyHashSHA256, AllQuery: true, IgnoreQueryPatterns: []string{"utm_*"}},
+			want:   "/static/app.js|GET|http://example.com?a=1&b=x+y|" + keyHashes[KeyHashSHA256]("headers||query|a=1|b=x y|cookies|"),
+		},
+		{
+			name:   "xxhash",
+			config: &KeyConfig{Hash: KeyHashXXHash},
+			want:   "/static/app.js|" + keyHashes[KeyHashXXHash]("headers||query||cookies|"),
+		},
+		{
+			name:   "readable key",
+			config: &KeyConfig{Template: "{host}{path}#{hash}", ReadableKey: true, Query: []string{"a"}},
+			want:   "example.com/static/app.js#headers||query|a=1|cookies|",
+		},
+		{
+			name:   "readable vary",
+			config: &KeyConfig{Template: "{scheme}://{host}{path}?{query}#{vary}", Query: []string{"a"}, Headers: []string{"accept-language"}, Cookies: []string{"region"}},
+			want:   "http://example.com/static/app.js?a=1#header:accept-language=en+US&cookie:region=eu",
+		},
+		{
+			name:   "head is the same as get",
+			method: http.MethodHead,
+			config: &KeyConfig{Template: "{method}|{path}|{hash}"},
+			want:   "GET|/static/app.js|" + getMD5Hash("headers||query||cookies|"),
+		},
+		{
+			name:   "host is normalized as by router",
+			host:   "Example.COM.:8080",
+			config: &KeyConfig{Template: "{host}{path}#{hash}", ReadableKey: true},
+			want:   "example.com/static/app.js#headers||query||cookies|",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.Validate(); err != nil {
+				t.Fatalf("Validate() error = %v", err)
+			}
+			method := tt.method
+			if method == "" {
+				method = http.MethodGet
+			}
+			r, err := http.NewRequest(method, "http://Example.com/static/app.js?b=x+y&a=1&utm_source=x", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.host != "" {
+				r.Host = tt.host
+			}
+			r.Header.Set("Accept-Language", "en US")
+			r.AddCookie(&http.Cookie{Name: "region", Value: "eu"})
+			if got := tt.config.Apply(r); got != tt.want {
+				t.Errorf("Apply() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyConfig_validateTemplate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  *KeyConfig
+		wantErr bool
+	}{
+		{name: "default", config: &KeyConfig{}, wantErr: false},
+		{name: "unknown hash", config: &KeyConfig{Hash: "crc32"}, wantErr: true},
+		{name: "unknown placeholder", config: &KeyConfig{Template: "{path}|{cookies}|{hash}"}, wantErr: true},
+		{name: "unclosed placeholder", config: &KeyConfig{Template: "{path}|{hash"}, wantErr: true},
+		{name: "without hash", config: &KeyConfig{Template: "{host}{path}"}, wantErr: true},
+		{name: "query and vary instead of hash", config: &KeyConfig{Template: "{scheme}://{host}{path}?{query}#{vary}"}, wantErr: false},
+		{name: "vary without query", config: &KeyConfig{Template: "{host}{path}#{vary}"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.validateTemplate(); (err != nil) != tt.wantErr {
+				t.Errorf("validateTemplate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package cache
+
+import (
+	"fmt"
+	"github.com/paragor/simple_cdn/pkg/utils/qvalue"
+	"regexp"
+	"strings"
+)
+
+// HeaderNormalizerConfig reduces value of header to part which changes response, only one field must be specified
+type HeaderNormalizerConfig struct {
+	// PrimaryLanguage - Accept-Language is reduced to most preferred supported language,
+	// language tag is matched as is (e.g. pt-br) and then by primary language (e.g. pt)
+	PrimaryLanguage *struct {
+		Supported []string `yaml:"supported"`
+		Default   string   `yaml:"default"`
+	} `yaml:"primary_language,omitempty"`
+	// Accept - Accept is reduced to list of supported media types, e.g. image/avif,image/webp
+	Accept *struct {
+		Types []string `yaml:"types"`
+	} `yaml:"accept,omitempty"`
+	// Regexp - value is reduced to first capture group of pattern (whole match if there are no groups)
+	Regexp *struct {
+		Pattern string `yaml:"pattern"`
+	} `yaml:"regexp,omitempty"`
+}
+
+var defaultAcceptTypes = []string{"image/avif", "image/webp"}
+
+func (c *HeaderNormalizerConfig) Validate() error {
+	found := 0
+	if c.PrimaryLanguage != nil {
+		found++
+		if len(c.PrimaryLanguage.Supported) == 0 {
+			return fmt.Errorf("primary_language: supported is empty")
+		}
+	}
+	if c.Accept != nil {
+		found++
+	}
+	if c.Regexp != nil {
+		found++
+		if _, err := regexp.Compile(c.Regexp.Pattern); err != nil {
+			return fmt.Errorf("regexp: %w", err)
+		}
+	}
+	if found != 1 {
+		return fmt.Errorf("need specify only 1 field of primary_language, accept, regexp, found %d", found)
+	}
+	return nil
+}
+
+type headerNormalizer interface {
+	normalize(value string) string
+}
+
+func (c *HeaderNormalizerConfig) toNormalizer() headerNormalizer {
+	if c.PrimaryLanguage != nil {
+		supported := make(map[string]struct{}, len(c.PrimaryLanguage.Supported))
+		for _, language := range c.PrimaryLanguage.Supported {
+			supported[strings.ToLower(language)] = struct{}{}
+		}
+		return &primaryLanguageNormalizer{supported: supported, fallback: strings.ToLower(c.PrimaryLanguage.Default)}
+	}
+	if c.Accept != nil {
+		types := c.Accept.Types
+		if len(types) == 0 {
+			types = defaultAcceptTypes
+		}
+		return &acceptNormalizer{types: types}
+	}
+	if c.Regexp != nil {
+		return &regexpNormalizer{re: regexp.MustCompile(c.Regexp.Pattern)}
+	}
+	panic("header normalizer: empty config")
+}
+
+type primaryLanguageNormalizer struct {
+	supported map[string]struct{}
+	fallback  string
+}
+
+func (n *primaryLanguageNormalizer) normalize(value string) string {
+	for _, language := range qvalue.Preferred(value) {
+		if _, ok := n.supported[language]; ok {
+			return language
+		}
+		primary, _, _ := strings.Cut(language, "-")
+		if _, ok := n.supported[primary]; ok {
+			return primary
+		}
+	}
+	return n.fallback
+}
+
+type acceptNormalizer struct {
+	types []string
+}
+
+func (n *acceptNormalizer) normalize(value string) string {
+	accepted := make(map[string]struct{})
+	for _, mediaType := range qvalue.Preferred(value) {
+		accepted[mediaType] = struct{}{}
+	}
+	result := make([]string, 0, len(n.types))
+	for _, mediaType := range n.types {
+		if _, ok := accepted[mediaType]; ok {
+			result = append(result, mediaType)
+		}
+	}
+	return strings.Join(result, ",")
+}
+
+type regexpNormalizer struct {
+	re *regexp.Regexp
+}
+
+func (n *regexpNormalizer) normalize(value string) string {
+	match := n.re.FindStringSubmatch(value)
+	if len(match) == 0 {
+		return ""
+	}
+	if len(match) > 1 {
+		return match[1]
+	}
+	return match[0]
+}
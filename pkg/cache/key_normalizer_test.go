@@ -0,0 +1,164 @@
+package cache
+
+import (
+	"gopkg.in/yaml.v3"
+	"net/http"
+	"testing"
+)
+
+func TestHeaderNormalizerConfig_normalize(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		value  string
+		want   string
+	}{
+		{
+			name:   "primary language by q-values",
+			config: "primary_language: {supported: [en, ru], default: en}",
+			value:  "de-DE,ru;q=0.8,en-US;q=0.9",
+			want:   "en",
+		},
+		{
+			name:   "primary language default",
+			config: "primary_language: {supported: [en, ru], default: en}",
+			value:  "de-DE,fr;q=0.9",
+			want:   "en",
+		},
+		{
+			name:   "primary language skips q=0",
+			config: "primary_language: {supported: [en, ru], default: en}",
+			value:  "EN;q=0,ru-RU;q=0.5",
+			want:   "ru",
+		},
+		{
+			name:   "primary language with region",
+			config: "primary_language: {supported: [pt, pt-BR, zh-TW], default: pt}",
+			value:  "zh-tw,pt-br;q=0.9",
+			want:   "zh-tw",
+		},
+		{
+			name:   "primary language falls back to primary subtag",
+			config: "primary_language: {supported: [pt, pt-BR], default: en}",
+			value:  "pt-PT,pt-BR;q=0.9",
+			want:   "pt",
+		},
+		{
+			name:   "accept default types",
+			config: "accept: {}",
+			value:  "image/webp,image/avif,image/png,*/*;q=0.8",
+			want:   "image/avif,image/webp",
+		},
+		{
+			name:   "accept without supported types",
+			config: "accept: {types: [image/webp]}",
+			value:  "text/html,*/*;q=0.8",
+			want:   "",
+		},
+		{
+			name:   "regexp capture group",
+			config: `regexp: {pattern: "^app-(\\w+)/"}`,
+			value:  "app-ios/1.2.3",
+			want:   "ios",
+		},
+		{
+			name:   "regexp whole match",
+			config: `regexp: {pattern: "v[0-9]+"}`,
+			value:  "client v2.5",
+			want:   "v2",
+		},
+		{
+			name:   "regexp without match",
+			config: `regexp: {pattern: "v[0-9]+"}`,
+			value:  "client",
+			want:   "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &HeaderNormalizerConfig{}
+			if err := yaml.Unmarshal([]byte(tt.config), config); err != nil {
+				t.Fatalf("yaml.Unmarshal() error = %v", err)
+			}
+			if err := config.Validate(); err != nil {
+				t.Fatalf("Validate() error = %v", err)
+			}
+			if got := config.toNormalizer().normalize(tt.value); got != tt.want {
+				t.Errorf("normalize() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeyConfig_headerNormalizers(t *testing.T) {
+	config := `
+headers: [Accept-Language]
+header_normalizers:
+  accept-language:
+    primary_language:
+      supported: [en, ru]
+      default: en
+`
+	kc := &KeyConfig{}
+	if err := yaml.Unmarshal([]byte(config), kc); err != nil {
+		t.Fatalf("yaml.Unmarshal() error = %v", err)
+	}
+	if err := kc.Validate(); err != nil {
+		t.Fatalf("Validate() error = %v", err)
+	}
+	first := kc.generateRawKeyForHash(createRequest("", http.Header{"Accept-Language": {"en-US,en;q=0.9"}}, nil))
+	second := kc.generateRawKeyForHash(createRequest("", http.Header{"Accept-Language": {"en-US,en;q=0.8"}}, nil))
+	if first != second || first != "headers|Accept-Language=en|query||cookies|" {
+		t.Errorf("generateRawKeyForHash() = %v and %v, want the same normalized keys", first, second)
+	}
+	vary := []string{"accept-language"}
+	firstVariant := kc.ApplyVary("key", createRequest("", http.Header{"Accept-Language": {"en-US,en;q=0.9"}}, nil), vary)
+	secondVariant := kc.ApplyVary("key", createRequest("", http.Header{"Accept-Language": {"en-GB"}}, nil), vary)
+	otherVariant := kc.ApplyVary("key", createRequest("", http.Header{"Accept-Language": {"ru"}}, nil), vary)
+	if firstVariant != secondVariant || firstVariant == otherVariant {
+		t.Errorf("ApplyVary() = %v, %v and %v, want the same variants of normalized values only", firstVariant, secondVariant, otherVariant)
+	}
+}
+
+func TestKeyConfig_headerNormalizersValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr bool
+	}{
+		{
+			name:   "header in key",
+			config: "headers: [Accept-Language]\nheader_normalizers: {accept-language: {regexp: {pattern: '^..'}}}",
+		},
+		{
+			name:   "all headers",
+			config: "all_headers: true\nheader_normalizers: {x-device: {regexp: {pattern: '^..'}}}",
+		},
+		{
+			name:    "all headers without not cachable header",
+			config:  "all_headers: true\nheader_normalizers: {accept-language: {regexp: {pattern: '^..'}}}",
+			wantErr: true,
+		},
+		{
+			name:    "header not in key",
+			config:  "headers: [Accept]\nheader_normalizers: {accept-language: {regexp: {pattern: '^..'}}}",
+			wantErr: true,
+		},
+		{
+			name:    "no headers in key",
+			config:  "header_normalizers: {accept-language: {regexp: {pattern: '^..'}}}",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kc := &KeyConfig{}
+			if err := yaml.Unmarshal([]byte(tt.config), kc); err != nil {
+				t.Fatalf("yaml.Unmarshal() error = %v", err)
+			}
+			if err := kc.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
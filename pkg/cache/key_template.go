@@ -0,0 +1,187 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/cespare/xxhash/v2"
+	"github.com/paragor/simple_cdn/pkg/utils/hostnorm"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	KeyHashMD5    = "md5"
+	KeyHashSHA256 = "sha256"
+	KeyHashXXHash = "xxhash"
+)
+
+// defaultKeyTemplate is format of keys before templates were introduced
+const defaultKeyTemplate = "{path}|{hash}"
+
+var keyHashes = map[string]func(text string) string{
+	KeyHashMD5: getMD5Hash,
+	KeyHashSHA256: func(text string) string {
+		sum := sha256.Sum256([]byte(text))
+		return hex.EncodeToString(sum[:])
+	},
+	KeyHashXXHash: func(text string) string {
+		return fmt.Sprintf("%016x", xxhash.Sum64String(text))
+	},
+}
+
+var keyTemplatePlaceholders = map[string]struct{}{
+	"method": {},
+	"scheme": {},
+	"host":   {},
+	"path":   {},
+	"query":  {},
+	"vary":   {},
+	"hash":   {},
+}
+
+type keyTemplatePart struct {
+	literal     string
+	placeholder string
+}
+
+// parseKeyTemplate splits template like {scheme}://{host}{path}|{hash} into literals and placeholders
+func parseKeyTemplate(template string) ([]keyTemplatePart, error) {
+	parts := []keyTemplatePart{}
+	for len(template) > 0 {
+		start := strings.Index(template, "{")
+		if start < 0 {
+			parts = append(parts, keyTemplatePart{literal: template})
+			break
+		}
+		if start > 0 {
+			parts = append(parts, keyTemplatePart{literal: template[:start]})
+		}
+		end := strings.Index(template[start:], "}")
+		if end < 0 {
+			return nil, fmt.Errorf("unclosed placeholder: %s", template[start:])
+		}
+		placeholder := template[start+1 : start+end]
+		if _, ok := keyTemplatePlaceholders[placeholder]; !ok {
+			return nil, fmt.Errorf("unknown placeholder: {%s}", placeholder)
+		}
+		parts = append(parts, keyTemplatePart{placeholder: placeholder})
+		template = template[start+end+1:]
+	}
+	return parts, nil
+}
+
+func (kc *KeyConfig) template() string {
+	if kc.Template == "" {
+		return defaultKeyTemplate
+	}
+	return kc.Template
+}
+
+func (kc *KeyConfig) hash() func(text string) string {
+	if hash, ok := keyHashes[kc.Hash]; ok {
+		return hash
+	}
+	return getMD5Hash
+}
+
+func (kc *KeyConfig) validateTemplate() error {
+	if _, ok := keyHashes[kc.Hash]; kc.Hash != "" && !ok {
+		return fmt.Errorf("hash should have value %s, %s or %s", KeyHashMD5, KeyHashSHA256, KeyHashXXHash)
+	}
+	parts, err := parseKeyTemplate(kc.template())
+	if err != nil {
+		return fmt.Errorf("template: %w", err)
+	}
+	placeholders := map[string]bool{}
+	for _, part := range parts {
+		placeholders[part.placeholder] = true
+	}
+	if placeholders["hash"] || (placeholders["query"] && placeholders["vary"]) {
+		return nil
+	}
+	return fmt.Errorf("template: {hash} or both {query} and {vary} are required, they contain headers, query, cookies and variants of key")
+}
+
+// Warnings returns problems of config which are not errors
+func (kc *KeyConfig) Warnings() []string {
+	template := kc.template()
+	warnings := []string{}
+	if !strings.Contains(template, "{host}") {
+		warnings = append(warnings, "cache_key_config: host is not in template, responses of different hosts share cache")
+	}
+	if !strings.HasPrefix(template, "{path}") {
+		warnings = append(warnings, "cache_key_config: template does not start with {path}, invalidation patterns must start with key prefix")
+	}
+	if kc.ReadableKey {
+		warnings = append(warnings, "cache_key_config: readable_key is set, header and cookie values are visible in cache keys")
+	} else if strings.Contains(template, "{vary}") {
+		warnings = append(warnings, "cache_key_config: template contains {vary}, header and cookie values are visible in cache keys")
+	}
+	return warnings
+}
+
+func (kc *KeyConfig) renderKey(r *http.Request) string {
+	key := &strings.Builder{}
+	key.Grow(256)
+	for _, part := range kc.templateParts {
+		switch part.placeholder {
+		case "":
+			key.WriteString(part.literal)
+		case "method":
+			// HEAD is served from cache of GET
+			if r.Method == http.MethodHead {
+				key.WriteString(http.MethodGet)
+			} else {
+				key.WriteString(r.Method)
+			}
+		case "scheme":
+			if r.TLS != nil {
+				key.WriteString("https")
+			} else {
+				key.WriteString("http")
+			}
+		case "host":
+			key.WriteString(hostnorm.Normalize(r.Host))
+		case "path":
+			key.WriteString(r.URL.Path)
+		case "query":
+			query := kc.keyQuery(r)
+			for i, k := range sortedKeys(query) {
+				for j, value := range query[k] {
+					if i != 0 || j != 0 {
+						key.WriteString("&")
+					}
+					key.WriteString(url.QueryEscape(k) + "=" + url.QueryEscape(value))
+				}
+			}
+		case "vary":
+			kc.renderVary(key, r)
+		case "hash":
+			if kc.ReadableKey {
+				key.WriteString(kc.generateRawKeyForHash(r))
+			} else {
+				key.WriteString(kc.hash()(kc.generateRawKeyForHash(r)))
+			}
+		}
+	}
+	return key.String()
+}
+
+// renderVary writes headers, cookies and variants of key like header:accept-language=en&cookie:session=abc&variant:device=mobile
+func (kc *KeyConfig) renderVary(key *strings.Builder, r *http.Request) {
+	pairs := []string{}
+	headers := kc.keyHeaders(r)
+	for _, k := range sortedKeys(headers) {
+		pairs = append(pairs, "header:"+url.QueryEscape(strings.ToLower(k))+"="+url.QueryEscape(headers[k]))
+	}
+	cookies := kc.keyCookies(r)
+	for _, k := range sortedKeys(cookies) {
+		pairs = append(pairs, "cookie:"+url.QueryEscape(k)+"="+url.QueryEscape(cookies[k]))
+	}
+	for _, dimension := range kc.variants {
+		pairs = append(pairs, "variant:"+url.QueryEscape(dimension.name)+"="+url.QueryEscape(dimension.match(r)))
+	}
+	key.WriteString(strings.Join(pairs, "&"))
+}
@@ -0,0 +1,45 @@
+package cache
+
+import (
+	"context"
+	"time"
+)
+
+// namespaceCache prefixes keys of inner cache, so several sites could share one cache backend
+type namespaceCache struct {
+	inner  Cache
+	prefix string
+}
+
+// NewNamespace returns cache with keys prefixed by "namespace:"
+func NewNamespace(inner Cache, namespace string) Cache {
+	return &namespaceCache{inner: inner, prefix: namespace + ":"}
+}
+
+func (c *namespaceCache) Get(ctx context.Context, key string) *Item {
+	return c.inner.Get(ctx, c.prefix+key)
+}
+
+func (c *namespaceCache) Set(ctx context.Context, key string, value *Item, mode WriteMode) {
+	c.inner.Set(ctx, c.prefix+key, value, mode)
+}
+
+func (c *namespaceCache) Refresh(ctx context.Context, key string, value *Item, revalidatedSavedAt time.Time) {
+	c.inner.Refresh(ctx, c.prefix+key, value, revalidatedSavedAt)
+}
+
+func (c *namespaceCache) GetEncoded(ctx context.Context, key string, savedAt time.Time, encoding string) []byte {
+	return c.inner.GetEncoded(ctx, c.prefix+key, savedAt, encoding)
+}
+
+func (c *namespaceCache) SetEncoded(ctx context.Context, key string, savedAt time.Time, encoding string, body []byte) {
+	c.inner.SetEncoded(ctx, c.prefix+key, savedAt, encoding, body)
+}
+
+func (c *namespaceCache) Invalidate(ctx context.Context, keyPattern string) error {
+	return c.inner.Invalidate(ctx, c.prefix+keyPattern)
+}
+
+func (c *namespaceCache) TryLock(ctx context.Context, key string, ttl time.Duration) (func(), bool, error) {
+	return c.inner.TryLock(ctx, c.prefix+key, ttl)
+}
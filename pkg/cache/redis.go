@@ -3,14 +3,17 @@ package cache
 import (
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"github.com/google/uuid"
 	"github.com/klauspost/compress/zstd"
+	"github.com/paragor/simple_cdn/pkg/compression"
 	"github.com/paragor/simple_cdn/pkg/logger"
 	"github.com/paragor/simple_cdn/pkg/metrics"
 	"github.com/paragor/simple_cdn/pkg/utils/pool"
 	"github.com/redis/go-redis/v9"
 	"go.uber.org/zap"
+	"math/rand"
+	"strconv"
 	"time"
 )
 
@@ -22,6 +25,8 @@ type RedisConfig struct {
 	GetTimeout        time.Duration `yaml:"get_timeout"`
 	SetTimeout        time.Duration `yaml:"set_timeout"`
 	ConnectionTimeout time.Duration `yaml:"connection_timeout"`
+	// TTLJitter - expiry of key is randomly shortened up to this fraction of ttl
+	TTLJitter float64 `yaml:"ttl_jitter"`
 }
 
 func (c *RedisConfig) Validate() error {
@@ -37,6 +42,9 @@ func (c *RedisConfig) Validate() error {
 	if c.SetTimeout <= 0 {
 		return fmt.Errorf("get_timeout shoud not <= 0")
 	}
+	if c.TTLJitter < 0 || c.TTLJitter >= 1 {
+		return fmt.Errorf("ttl_jitter shoud be in [0, 1)")
+	}
 	return nil
 }
 
@@ -56,12 +64,14 @@ func (c *RedisConfig) Cache() Cache {
 		}),
 		c.SetTimeout,
 		c.GetTimeout,
+		c.TTLJitter,
 	)
 }
 
 type redisCache struct {
 	getTimeout time.Duration
 	setTimeout time.Duration
+	ttlJitter  float64
 	client     *redis.Client
 }
 
@@ -69,35 +79,119 @@ func newRedisCache(
 	client *redis.Client,
 	setTimeout time.Duration,
 	getTimeout time.Duration,
+	ttlJitter float64,
 ) Cache {
 	return &redisCache{
 		client:     client,
 		setTimeout: setTimeout,
 		getTimeout: getTimeout,
+		ttlJitter:  ttlJitter,
+	}
+}
+
+// expiry spreads expiration of keys written at the same time
+func (c *redisCache) expiry(ttl time.Duration) time.Duration {
+	if c.ttlJitter <= 0 {
+		return ttl
 	}
+	return ttl - time.Duration(rand.Float64()*c.ttlJitter*float64(ttl))
 }
 
+// item is stored as hash: "meta" is compressed json of item without body, "body" is compressed body,
+// "saved_at" is SavedAt in unix microseconds for compare-and-swap, "enc:<coding>" are optional encoded bodies.
+// So metadata could be refreshed without touching the body.
+// Body is compressed by zstd, so it is also served as zstd encoded body.
+const (
+	redisFieldMeta          = "meta"
+	redisFieldBody          = "body"
+	redisFieldSavedAt       = "saved_at"
+	redisFieldEncodedPrefix = "enc:"
+)
+
+// redisSetScript saves item according to write mode, values of legacy format are replaced
+var redisSetScript = redis.NewScript(`
+local t = redis.call('TYPE', KEYS[1]).ok
+if t ~= 'hash' and t ~= 'none' then
+	redis.call('DEL', KEYS[1])
+	t = 'none'
+end
+if t == 'hash' then
+	if ARGV[5] == 'insert' then
+		return 0
+	end
+	if ARGV[5] == 'cas' then
+		local savedAt = tonumber(redis.call('HGET', KEYS[1], 'saved_at'))
+		if savedAt and savedAt >= tonumber(ARGV[3]) then
+			return 0
+		end
+	end
+end
+redis.call('DEL', KEYS[1])
+redis.call('HSET', KEYS[1], 'meta', ARGV[1], 'body', ARGV[2], 'saved_at', ARGV[3])
+for i = 6, #ARGV, 2 do
+	redis.call('HSET', KEYS[1], ARGV[i], ARGV[i + 1])
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+return 1
+`)
+
+// redisRefreshScript replaces metadata of stored item if it is still the revalidated one
+var redisRefreshScript = redis.NewScript(`
+if redis.call('TYPE', KEYS[1]).ok ~= 'hash' then
+	return 0
+end
+if redis.call('HGET', KEYS[1], 'saved_at') ~= ARGV[4] then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'meta', ARGV[1], 'saved_at', ARGV[2])
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+return 1
+`)
+
+// redisSetEncodedScript adds encoded body to stored item if it is still the one saved at saved_at
+var redisSetEncodedScript = redis.NewScript(`
+if redis.call('TYPE', KEYS[1]).ok ~= 'hash' then
+	return 0
+end
+if redis.call('HGET', KEYS[1], 'saved_at') ~= ARGV[1] then
+	return 0
+end
+redis.call('HSET', KEYS[1], ARGV[2], ARGV[3])
+return 1
+`)
+
 func (c *redisCache) Get(ctx context.Context, key string) *Item {
 	log := logger.FromCtx(ctx).
 		With(zap.String("component", "cache.redis")).
 		With(zap.String("cache_key", key))
 	ctx, cancel := context.WithTimeout(context.Background(), c.getTimeout)
 	defer cancel()
-	redisValueCompressed, err := c.client.Get(ctx, key).Bytes()
-	if err != nil {
-		if errors.Is(err, redis.Nil) {
-			return nil
+	// encoded bodies are not fetched, they are fetched by GetEncoded only for clients which accept them
+	values, err := c.client.HMGet(ctx, key, redisFieldMeta, redisFieldBody).Result()
+	if redis.HasErrorPrefix(err, "WRONGTYPE") {
+		// value of legacy format (plain string) is a miss, it is removed to avoid errors till it expires
+		log.Debug("cache value of legacy format is removed")
+		if err := c.client.Del(ctx, key).Err(); err != nil {
+			log.With(zap.Error(err)).Warn("cant remove cache value of legacy format")
 		}
+		return nil
+	}
+	if err != nil {
 		log.With(zap.Error(err)).Error("cant get cache")
 		metrics.CacheErrors.Inc()
 		return nil
 	}
-	bytesBuffer := pool.DefaultBufferPool.Get(max(len(redisValueCompressed)*zstdGoodCompressionRatio, pool.DefaultBufferPoolMaxSize))
+	metaCompressed, metaOk := values[0].(string)
+	bodyCompressed, bodyOk := values[1].(string)
+	if !metaOk || !bodyOk {
+		return nil
+	}
+	bytesBuffer := pool.DefaultBufferPool.Get(max(len(metaCompressed)*zstdGoodCompressionRatio, pool.DefaultBufferPoolMaxSize))
 	defer func() {
 		pool.DefaultBufferPool.Put(bytesBuffer[:0])
 	}()
 
-	bytesBuffer, err = zstdDecoder.DecodeAll(redisValueCompressed, bytesBuffer)
+	bytesBuffer, err = zstdDecoder.DecodeAll([]byte(metaCompressed), bytesBuffer)
 	if err != nil {
 		log.With(zap.Error(err)).Error("cant decompress cache")
 		metrics.CacheErrors.Inc()
@@ -112,37 +206,155 @@ func (c *redisCache) Get(ctx context.Context, key string) *Item {
 	if !item.CacheHeader.ShouldCDNPersist() {
 		return nil
 	}
+	item.Body, err = zstdDecoder.DecodeAll([]byte(bodyCompressed), make([]byte, 0, len(bodyCompressed)*zstdGoodCompressionRatio))
+	if err != nil {
+		log.With(zap.Error(err)).Error("cant decompress cache body")
+		metrics.CacheErrors.Inc()
+		return nil
+	}
+	item.Encoded = map[string][]byte{compression.Zstd: []byte(bodyCompressed)}
 	return item
 }
 
-func (c *redisCache) Set(ctx context.Context, key string, value *Item) {
+func (c *redisCache) GetEncoded(ctx context.Context, key string, savedAt time.Time, encoding string) []byte {
+	if encoding == compression.Zstd {
+		// body is stored as zstd, it is returned by Get
+		return nil
+	}
 	log := logger.FromCtx(ctx).
 		With(zap.String("component", "cache.redis")).
-		With(zap.String("cache_key", key))
+		With(zap.String("cache_key", key)).
+		With(zap.String("encoding", encoding))
+	ctx, cancel := context.WithTimeout(context.Background(), c.getTimeout)
+	defer cancel()
+	values, err := c.client.HMGet(ctx, key, redisFieldSavedAt, redisFieldEncodedPrefix+encoding).Result()
+	if err != nil {
+		log.With(zap.Error(err)).Error("cant get encoded body")
+		metrics.CacheErrors.Inc()
+		return nil
+	}
+	storedSavedAt, _ := values[0].(string)
+	encoded, ok := values[1].(string)
+	if !ok || storedSavedAt != strconv.FormatInt(savedAt.UnixMicro(), 10) {
+		return nil
+	}
+	return []byte(encoded)
+}
+
+func (c *redisCache) Set(ctx context.Context, key string, value *Item, mode WriteMode) {
+	log := logger.FromCtx(ctx).
+		With(zap.String("component", "cache.redis")).
+		With(zap.String("cache_key", key)).
+		With(zap.Stringer("write_mode", mode))
 	ttl := value.CacheHeader.ttl()
 	if ttl <= 0 {
 		return
 	}
-	data, err := json.Marshal(value)
+	metaBuffer, ok := c.encodeMeta(log, value)
+	if !ok {
+		return
+	}
+	defer func() {
+		pool.DefaultBufferPool.Put(metaBuffer[:0])
+	}()
+	bodyBuffer, encoded := value.Encoded[compression.Zstd]
+	if !encoded {
+		bodyBuffer = pool.DefaultBufferPool.Get(max(pool.DefaultBufferPoolMaxSize, len(value.Body)/zstdBadCompressionRatio))
+		defer func() {
+			pool.DefaultBufferPool.Put(bodyBuffer[:0])
+		}()
+		bodyBuffer = zstdEncoder.EncodeAll(value.Body, bodyBuffer)
+	}
+	args := []any{
+		metaBuffer,
+		bodyBuffer,
+		value.SavedAt.UnixMicro(),
+		c.expiry(ttl).Milliseconds(),
+		mode.String(),
+	}
+	for encoding, body := range value.Encoded {
+		if encoding != compression.Zstd {
+			args = append(args, redisFieldEncodedPrefix+encoding, body)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.setTimeout)
+	defer cancel()
+	err := redisSetScript.Run(ctx, c.client, []string{key}, args...).Err()
 	if err != nil {
-		log.With(zap.Error(err)).Error("cant marshal cache")
+		log.With(zap.Error(err)).Error("cant save cache")
 		metrics.CacheErrors.Inc()
+	}
+}
+
+func (c *redisCache) Refresh(ctx context.Context, key string, value *Item, revalidatedSavedAt time.Time) {
+	log := logger.FromCtx(ctx).
+		With(zap.String("component", "cache.redis")).
+		With(zap.String("cache_key", key))
+	ttl := value.CacheHeader.ttl()
+	if ttl <= 0 {
+		return
+	}
+	metaBuffer, ok := c.encodeMeta(log, value)
+	if !ok {
 		return
 	}
-	bytesBuffer := pool.DefaultBufferPool.Get(max(pool.DefaultBufferPoolMaxSize, len(data)/zstdBadCompressionRatio))
 	defer func() {
-		pool.DefaultBufferPool.Put(bytesBuffer[:0])
+		pool.DefaultBufferPool.Put(metaBuffer[:0])
 	}()
-	bytesBuffer = zstdEncoder.EncodeAll(data, bytesBuffer)
 	ctx, cancel := context.WithTimeout(context.Background(), c.setTimeout)
 	defer cancel()
-	_, err = c.client.SetNX(ctx, key, bytesBuffer, ttl).Result()
+	err := redisRefreshScript.Run(
+		ctx,
+		c.client,
+		[]string{key},
+		metaBuffer,
+		value.SavedAt.UnixMicro(),
+		c.expiry(ttl).Milliseconds(),
+		strconv.FormatInt(revalidatedSavedAt.UnixMicro(), 10),
+	).Err()
 	if err != nil {
-		log.With(zap.Error(err)).Error("cant save cache")
+		log.With(zap.Error(err)).Error("cant refresh cache")
 		metrics.CacheErrors.Inc()
 	}
 }
 
+func (c *redisCache) SetEncoded(ctx context.Context, key string, savedAt time.Time, encoding string, body []byte) {
+	if encoding == compression.Zstd {
+		// body is stored as zstd
+		return
+	}
+	log := logger.FromCtx(ctx).
+		With(zap.String("component", "cache.redis")).
+		With(zap.String("cache_key", key)).
+		With(zap.String("encoding", encoding))
+	ctx, cancel := context.WithTimeout(context.Background(), c.setTimeout)
+	defer cancel()
+	err := redisSetEncodedScript.Run(
+		ctx,
+		c.client,
+		[]string{key},
+		strconv.FormatInt(savedAt.UnixMicro(), 10),
+		redisFieldEncodedPrefix+encoding,
+		body,
+	).Err()
+	if err != nil {
+		log.With(zap.Error(err)).Error("cant save encoded body")
+		metrics.CacheErrors.Inc()
+	}
+}
+
+// encodeMeta returns buffer from pool.DefaultBufferPool, caller should return it back
+func (c *redisCache) encodeMeta(log *zap.Logger, value *Item) ([]byte, bool) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		log.With(zap.Error(err)).Error("cant marshal cache")
+		metrics.CacheErrors.Inc()
+		return nil, false
+	}
+	bytesBuffer := pool.DefaultBufferPool.Get(max(pool.DefaultBufferPoolMinSize, len(data)/zstdBadCompressionRatio))
+	return zstdEncoder.EncodeAll(data, bytesBuffer), true
+}
+
 const zstdBadCompressionRatio = 2
 const zstdGoodCompressionRatio = 3
 
@@ -161,6 +373,42 @@ func init() {
 	}
 }
 
+const redisLockPrefix = "lock|"
+
+// redisUnlockScript deletes lock only if it is still held by the same holder
+var redisUnlockScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+func (c *redisCache) TryLock(ctx context.Context, key string, ttl time.Duration) (func(), bool, error) {
+	log := logger.FromCtx(ctx).
+		With(zap.String("component", "cache.redis")).
+		With(zap.String("cache_key", key))
+	lockKey := redisLockPrefix + key
+	token := uuid.NewString()
+	setCtx, cancel := context.WithTimeout(context.Background(), c.setTimeout)
+	defer cancel()
+	acquired, err := c.client.SetNX(setCtx, lockKey, token, ttl).Result()
+	if err != nil {
+		metrics.CacheErrors.Inc()
+		return nil, false, fmt.Errorf("cant take lock: %w", err)
+	}
+	if !acquired {
+		return nil, false, nil
+	}
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), c.setTimeout)
+		defer cancel()
+		if err := redisUnlockScript.Run(ctx, c.client, []string{lockKey}, token).Err(); err != nil {
+			log.With(zap.Error(err)).Error("cant release lock")
+			metrics.CacheErrors.Inc()
+		}
+	}, true, nil
+}
+
 func (c *redisCache) Invalidate(ctx context.Context, keyPattern string) error {
 	log := logger.FromCtx(ctx)
 	metrics.CacheInvalidations.Inc()
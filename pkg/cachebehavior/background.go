@@ -0,0 +1,117 @@
+package cachebehavior
+
+import (
+	"container/list"
+	"context"
+	"github.com/paragor/simple_cdn/pkg/metrics"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	backgroundJobRevalidation = "revalidation"
+	backgroundJobCacheSaving  = "cache_saving"
+)
+
+type backgroundJob struct {
+	kind string
+	// key deduplicates queued jobs, empty key means no deduplication.
+	// Key is cache key without namespace, so one pool must never serve more than one cache namespace
+	key string
+	run func()
+	// drop is called instead of run if job is dropped, could be nil
+	drop       func()
+	enqueuedAt time.Time
+}
+
+// backgroundPool runs cache fills and revalidations with bounded number of workers and bounded queue
+type backgroundPool struct {
+	m          sync.Mutex
+	cond       *sync.Cond
+	queue      *list.List
+	queued     map[string]struct{}
+	queueSize  int
+	dropOldest bool
+}
+
+func newBackgroundPool(workers int, queueSize int, dropOldest bool) *backgroundPool {
+	p := &backgroundPool{
+		queue:      list.New(),
+		queued:     make(map[string]struct{}),
+		queueSize:  queueSize,
+		dropOldest: dropOldest,
+	}
+	p.cond = sync.NewCond(&p.m)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// submit enqueues job, returns false if job is dropped
+func (p *backgroundPool) submit(job *backgroundJob) bool {
+	job.enqueuedAt = time.Now()
+	var dropped *backgroundJob
+	p.m.Lock()
+	if _, ok := p.queued[job.key]; ok && job.key != "" {
+		p.m.Unlock()
+		metrics.BackgroundDroppedJobs.WithLabelValues(job.kind, "duplicate").Inc()
+		job.dropJob()
+		return false
+	}
+	if p.queue.Len() >= p.queueSize {
+		if !p.dropOldest {
+			p.m.Unlock()
+			metrics.BackgroundDroppedJobs.WithLabelValues(job.kind, "queue_full").Inc()
+			job.dropJob()
+			return false
+		}
+		dropped = p.queue.Remove(p.queue.Front()).(*backgroundJob)
+		delete(p.queued, dropped.key)
+	}
+	p.queue.PushBack(job)
+	if job.key != "" {
+		p.queued[job.key] = struct{}{}
+	}
+	metrics.BackgroundQueueDepth.Set(float64(p.queue.Len()))
+	p.cond.Signal()
+	p.m.Unlock()
+
+	if dropped != nil {
+		metrics.BackgroundDroppedJobs.WithLabelValues(dropped.kind, "queue_full").Inc()
+		dropped.dropJob()
+	}
+	return true
+}
+
+func (p *backgroundPool) work() {
+	for {
+		p.m.Lock()
+		for p.queue.Len() == 0 {
+			p.cond.Wait()
+		}
+		job := p.queue.Remove(p.queue.Front()).(*backgroundJob)
+		delete(p.queued, job.key)
+		metrics.BackgroundQueueDepth.Set(float64(p.queue.Len()))
+		p.m.Unlock()
+
+		job.run()
+		metrics.BackgroundJobLatency.
+			WithLabelValues(job.kind).
+			Observe(time.Now().Sub(job.enqueuedAt).Seconds())
+	}
+}
+
+func (job *backgroundJob) dropJob() {
+	if job.drop != nil {
+		job.drop()
+	}
+}
+
+// detachedRequest returns request which is not canceled when client is gone, so background job
+// (e.g. its upstream retries) outlives handler, it is limited by timeout instead
+func detachedRequest(r *http.Request, timeout time.Duration) (*http.Request, context.CancelFunc) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), timeout)
+	return r.WithContext(ctx), cancel
+}
@@ -0,0 +1,60 @@
+package cachebehavior
+
+import (
+	"slices"
+	"testing"
+)
+
+func Test_backgroundPool_submit(t *testing.T) {
+	initMetricsAndLogs()
+	tests := []struct {
+		name        string
+		dropOldest  bool
+		keys        []string
+		wantQueued  []string
+		wantDropped []string
+	}{
+		{
+			name:        "drop new",
+			keys:        []string{"a", "b", "c"},
+			wantQueued:  []string{"a", "b"},
+			wantDropped: []string{"c"},
+		},
+		{
+			name:        "drop oldest",
+			dropOldest:  true,
+			keys:        []string{"a", "b", "c"},
+			wantQueued:  []string{"b", "c"},
+			wantDropped: []string{"a"},
+		},
+		{
+			name:        "deduplication",
+			keys:        []string{"a", "a", ""},
+			wantQueued:  []string{"a", ""},
+			wantDropped: []string{"a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// without workers jobs stay in queue
+			p := newBackgroundPool(0, 2, tt.dropOldest)
+			dropped := []string{}
+			for _, key := range tt.keys {
+				key := key
+				p.submit(&backgroundJob{kind: backgroundJobRevalidation, key: key, run: func() {}, drop: func() {
+					dropped = append(dropped, key)
+				}})
+			}
+			queued := []string{}
+			for e := p.queue.Front(); e != nil; e = e.Next() {
+				queued = append(queued, e.Value.(*backgroundJob).key)
+			}
+			if !slices.Equal(queued, tt.wantQueued) {
+				t.Errorf("queued = %v, want %v", queued, tt.wantQueued)
+			}
+			if !slices.Equal(dropped, tt.wantDropped) {
+				t.Errorf("dropped = %v, want %v", dropped, tt.wantDropped)
+			}
+		})
+	}
+}
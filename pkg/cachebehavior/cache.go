@@ -2,6 +2,7 @@ package cachebehavior
 
 import (
 	"bytes"
+	"context"
 	"github.com/paragor/simple_cdn/pkg/cache"
 	"github.com/paragor/simple_cdn/pkg/logger"
 	"github.com/paragor/simple_cdn/pkg/metrics"
@@ -10,6 +11,7 @@ import (
 	"github.com/paragor/simple_cdn/pkg/utils/pool"
 	"go.uber.org/zap"
 	"io"
+	"math/rand"
 	"net/http"
 	"strings"
 	"time"
@@ -23,6 +25,9 @@ type cacheBehavior struct {
 	canPersistCache    user.User
 	canLoadCache       user.User
 	cacheControlParser CacheControlParser
+	config             *Config
+	inflight           *inflightRequests
+	pool               *backgroundPool
 }
 
 func NewCacheBehavior(
@@ -32,6 +37,7 @@ func NewCacheBehavior(
 	upstream upstream.Upstream,
 	cache cache.Cache,
 	cacheControlParser CacheControlParser,
+	config *Config,
 ) http.Handler {
 	return &cacheBehavior{
 		upstream:           upstream,
@@ -40,6 +46,9 @@ func NewCacheBehavior(
 		canPersistCache:    canPersistCache,
 		canLoadCache:       canLoadCache,
 		cacheControlParser: cacheControlParser,
+		config:             config,
+		inflight:           newInflightRequests(),
+		pool:               config.getBackgroundPool(),
 	}
 }
 func (b *cacheBehavior) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -51,8 +60,11 @@ func (b *cacheBehavior) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			With(zap.Bool("can_persist_cache", canPersistCache)).
 			With(zap.Bool("can_load_cache", canLoadCache))
 
+	if r.Method == http.MethodHead {
+		w = &headResponseWriter{ResponseWriter: w}
+	}
 	now := time.Now()
-	if r.Method != http.MethodGet || (!canPersistCache && !canLoadCache) {
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || (!canPersistCache && !canLoadCache) {
 		log.Debug("just proxy pass")
 		response, err := b.upstream.Do(r)
 		if err != nil {
@@ -69,10 +81,14 @@ func (b *cacheBehavior) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	primaryKey := b.cacheKeyConfig.Apply(r)
+	cacheKey := primaryKey
+	// requests of the same item go to the same target of consistent hash balancing
+	r = r.WithContext(upstream.WithHashKey(r.Context(), primaryKey))
 	var cacheItem *cache.Item
 	if canLoadCache {
 		start := time.Now()
-		cacheItem = b.cache.Get(r.Context(), b.cacheKeyConfig.Apply(r))
+		cacheKey, cacheItem = b.load(r.Context(), r, primaryKey)
 		cacheStatus := metrics.BoolToString(cacheItem != nil, "HIT", "MISS")
 		metrics.CacheLoadTime.
 			WithLabelValues(cacheStatus).
@@ -84,67 +100,122 @@ func (b *cacheBehavior) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if cacheItem != nil && cacheItem.CanUseCache(now) {
 		log.Debug("response from cache")
 		w.Header().Set("X-Cache-Status", "HIT")
-		if err := cacheItem.Write(w); err != nil {
+		if err := b.serveStored(w, r, cacheKey, cacheItem); err != nil {
 			log.With(zap.Error(err)).Warn("cant write cache response")
 		}
+		if canPersistCache && b.config.EarlyRefresh.Enabled &&
+			cacheItem.ShouldRefreshEarly(now, b.config.EarlyRefresh.beta(), 1-rand.Float64()) {
+			log.Debug("early refresh of cache")
+			metrics.EarlyRefreshes.Inc()
+			b.revalidateInBackground(r, log, primaryKey, cacheKey, cacheItem)
+		}
 		return
 	}
 
 	if cacheItem != nil && cacheItem.CanStaleWhileRevalidation(now) {
 		log.Debug("response from stale")
 		w.Header().Set("X-Cache-Status", "HIT-STALE")
-		if err := cacheItem.Write(w); err != nil {
+		if err := b.serveStored(w, r, cacheKey, cacheItem); err != nil {
 			log.With(zap.Error(err)).Warn("cant write cache response")
 		}
 		if !canPersistCache {
 			return
 		}
-		go func() {
-			cacheIsInvalidated := false
-			log = log.With(zap.String("goroutine", "invalidation"))
-			defer func() {
-				log.With(zap.Bool("is_invalidated", cacheIsInvalidated)).Debug("stale cache invalidated")
-			}()
-			response, err := b.upstream.Do(r)
-			if err != nil {
-				log.With(zap.Error(err)).Error("upstream error")
-				return
-			}
-			defer response.Body.Close()
-			log = log.With(zap.Int("upstream_status", response.StatusCode))
-			if response.StatusCode != 200 {
-				log.Warn("not cachable status code")
-				return
-			}
-			cacheBytesBuffer := pool.DefaultBufferPool.Get(max(pool.DefaultBufferPoolMinSize, int(response.ContentLength)))
-			defer func() {
-				pool.DefaultBufferPool.Put(cacheBytesBuffer[:0])
-			}()
-			buffer := bytes.NewBuffer(cacheBytesBuffer)
-			if _, err := buffer.ReadFrom(response.Body); err != nil {
-				log.With(zap.Error(err)).Error("cant read upstream body")
+		b.revalidateInBackground(r, log, primaryKey, cacheKey, cacheItem)
+		return
+	}
+
+	inflight := newInflightRequest(nil, cacheKey)
+	if b.config.Coalescing.Enabled && canPersistCache && canLoadCache {
+		leaderInflight, leader := b.inflight.acquire(cacheKey)
+		if leader {
+			inflight = leaderInflight
+		} else {
+			item, result := leaderInflight.wait(r.Context(), b.config.Coalescing.MaxWait, func(vary []string) string {
+				return b.cacheKeyConfig.ApplyVary(primaryKey, r, vary)
+			})
+			metrics.CollapsedRequests.WithLabelValues(result).Inc()
+			if item != nil {
+				log.Debug("response from collapsed request")
+				w.Header().Set("X-Cache-Status", "HIT-COLLAPSED")
+				if err := b.serve(w, r, item); err != nil {
+					log.With(zap.Error(err)).Warn("cant write cache response")
+				}
 				return
 			}
-			cacheControl := b.cacheControlParser.GetCacheControl(r, response)
-			if !cacheControl.ShouldCDNPersist() {
-				return
+			log.With(zap.String("collapsing_result", result)).Debug("collapsed request fallback to upstream")
+		}
+	}
+	defer inflight.release(nil)
+	fill := &fillLock{}
+	defer fill.releaseByHandler()
+	if canPersistCache && b.config.RevalidationLock.BlockingFill {
+		release, locked := b.lockRevalidation(r.Context(), cacheKey)
+		if locked {
+			fill.release = release
+		} else if cacheItem != nil && cacheItem.CanStaleIfError(now) {
+			log.Debug("response from stale, cache is filled by other replica")
+			w.Header().Set("X-Cache-Status", "HIT-STALE")
+			if err := b.serveStored(w, r, cacheKey, cacheItem); err != nil {
+				log.With(zap.Error(err)).Warn("cant write cache response")
 			}
-			item := cache.ItemFromResponse(response, cacheControl, buffer.Bytes())
-			if item == nil {
-				return
+			return
+		} else if item := b.waitRemoteFill(r, primaryKey); item != nil {
+			metrics.CollapsedRequests.WithLabelValues("remote_hit").Inc()
+			log.Debug("response from cache filled by other replica")
+			w.Header().Set("X-Cache-Status", "HIT-COLLAPSED")
+			if err := b.serve(w, r, item); err != nil {
+				log.With(zap.Error(err)).Warn("cant write cache response")
 			}
-			b.cache.Set(r.Context(), b.cacheKeyConfig.Apply(r), item)
-			cacheIsInvalidated = true
-		}()
-		return
+			return
+		}
 	}
 
-	response, err := b.upstream.Do(r)
+	upstreamRequest, conditional := r, false
+	if cacheItem != nil {
+		upstreamRequest, conditional = revalidationRequest(r, cacheItem)
+	}
+	if canPersistCache && b.config.RangeRequests.FetchFullMaxSize > 0 {
+		upstreamRequest = fullObjectRequest(upstreamRequest)
+	}
+	if canPersistCache && b.config.HeadRequests.FillWithGet {
+		upstreamRequest = getRequest(upstreamRequest)
+	}
+	fetchStart := time.Now()
+	var response *http.Response
+	var err error
+	if cacheItem != nil && b.config.StaleIfSlow.Budget > 0 && cacheItem.CanStaleIfError(now) {
+		var answered bool
+		// late response could come after handler is finished, so lock is released and request is canceled by late refresh
+		var cancel context.CancelFunc
+		upstreamRequest, cancel = detachedRequest(upstreamRequest, b.config.Background.requestTimeout())
+		release := fill.handOver()
+		lateRelease := func(success bool) {
+			release(success)
+			cancel()
+		}
+		response, answered, err = b.doWithBudget(upstreamRequest, b.config.StaleIfSlow.Budget, func(response *http.Response, err error) {
+			b.refreshFromLateResponse(upstreamRequest.Context(), log, primaryKey, cacheKey, cacheItem, upstreamRequest, conditional, response, err, canPersistCache, fetchStart, lateRelease)
+		})
+		if answered {
+			defer cancel()
+			fill.release = release
+		} else {
+			log.Debug("response from stale, upstream is slow")
+			w.Header().Set("X-Cache-Status", "HIT-SLOW")
+			if err := b.serveStored(w, r, cacheKey, cacheItem); err != nil {
+				log.With(zap.Error(err)).Warn("cant write cache response")
+			}
+			return
+		}
+	} else {
+		response, err = b.upstream.Do(upstreamRequest)
+	}
 	if err != nil {
 		if cacheItem != nil && cacheItem.CanStaleIfError(now) {
 			log.With(zap.Error(err)).Debug("use stale cache")
 			w.Header().Set("X-Cache-Status", "HIT-ERROR")
-			if err := cacheItem.Write(w); err != nil {
+			if err := b.serveStored(w, r, cacheKey, cacheItem); err != nil {
 				log.With(zap.Error(err)).Warn("cant write cache response")
 			}
 			return
@@ -156,11 +227,44 @@ func (b *cacheBehavior) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	defer response.Body.Close()
 	log = log.With(zap.Int("upstream_status", response.StatusCode))
+	if conditional {
+		metrics.CacheRevalidations.WithLabelValues(revalidationResult(response.StatusCode)).Inc()
+	}
+	if conditional && response.StatusCode == http.StatusNotModified {
+		log.Debug("response from revalidated cache")
+		item := b.revalidatedItem(upstreamRequest, response, cacheItem, time.Since(fetchStart))
+		w.Header().Set("X-Cache-Status", "REVALIDATED")
+		if err := b.serve(w, r, item); err != nil {
+			log.With(zap.Error(err)).Warn("cant write cache response")
+		}
+		if !canPersistCache || !item.CacheHeader.ShouldCDNPersist() {
+			return
+		}
+		inflight.release(item)
+		ctx := r.Context()
+		release := fill.handOver()
+		b.pool.submit(&backgroundJob{
+			kind: backgroundJobCacheSaving,
+			drop: func() {
+				release(false)
+			},
+			run: func() {
+				release(b.saveRevalidated(ctx, upstreamRequest, primaryKey, cacheKey, cacheItem, item))
+				log.With(zap.String("goroutine", "cache_refreshing")).Debug("refresh cache")
+			},
+		})
+		return
+	}
+	if response.StatusCode == http.StatusPartialContent {
+		log.Debug("response to client with partial content")
+		proxyResponse(w, response, "MISS", log)
+		return
+	}
 	if response.StatusCode != 200 {
 		if response.StatusCode >= 500 && cacheItem != nil && cacheItem.CanStaleIfError(now) {
 			log.Info("response from cache due code >= 500")
 			w.Header().Set("X-Cache-Status", "HIT-ERROR")
-			if err := cacheItem.Write(w); err != nil {
+			if err := b.serveStored(w, r, cacheKey, cacheItem); err != nil {
 				log.With(zap.Error(err)).Warn("cant write cache response")
 			}
 			return
@@ -174,13 +278,30 @@ func (b *cacheBehavior) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 		return
 	}
+	cacheControl := b.cacheControlParser.GetCacheControl(upstreamRequest, response)
+	vary, varyCachable := b.config.Vary.headers(response.Header)
+	canPersist := canPersistCache && upstreamRequest.Method == http.MethodGet && cacheControl.ShouldCDNPersist() && varyCachable
+	if reason := b.config.objectSizeSkipReason(response.ContentLength); canPersist && reason != "" {
+		skipObject(log, reason)
+		canPersist = false
+	}
+	key := b.storageKey(r, primaryKey, vary)
+	if isRangeRequest(r) {
+		b.serveRangeFromFullResponse(w, r, upstreamRequest, response, key, canPersist, cacheControl, inflight, fill)
+		return
+	}
 	copyHeaders(response.Header, w.Header())
 	w.Header().Set("X-Cache-Status", "MISS")
+	body := b.compressResponse(w, r, response)
+	defer func() {
+		if err := body.Close(); err != nil {
+			log.With(zap.Error(err)).Warn("cant write response body")
+		}
+	}()
 	w.WriteHeader(response.StatusCode)
-	cacheControl := b.cacheControlParser.GetCacheControl(r, response)
-	if !canPersistCache || !cacheControl.ShouldCDNPersist() {
+	if !canPersist {
 		log.Debug("response to client without cache save")
-		if err = ioCopy(w, response.Body); err != nil {
+		if err = ioCopy(body, response.Body); err != nil {
 			log.With(zap.Error(err)).Warn("cant write response body")
 		}
 		return
@@ -191,26 +312,276 @@ func (b *cacheBehavior) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		pool.DefaultBufferPool.Put(bodyBytes[:0])
 	}
 	bodyBuffer := bytes.NewBuffer(bodyBytes)
-	if err := ioCopyWithPersist(w, response.Body, bodyBuffer); err != nil {
-		log.With(zap.Error(err)).Error("cant read all body from upstream")
+	persist, err := ioCopyWithPersist(body, response.Body, bodyBuffer, b.config.MaxObjectSize)
+	if err != nil {
+		log.With(zap.Error(err)).Warn("cant stream body, cache is not saved")
+		bodyBytesClean()
+		return
+	}
+	if !persist {
+		skipObject(log, objectTooBig)
+		bodyBytesClean()
+		return
+	}
+	if reason := b.config.objectSizeSkipReason(int64(bodyBuffer.Len())); reason != "" {
+		skipObject(log, reason)
 		bodyBytesClean()
 		return
 	}
-	ctx := r.Context()
-	go func() {
+	item := cache.ItemFromResponse(response, cacheControl, bodyBuffer.Bytes())
+	item.FetchDuration = time.Since(fetchStart)
+	if inflight.releaseVariant(item, key.variant, key.vary) {
+		// followers could write body after persisting, so buffer is not returned to pool
+		bodyBytesClean = func() {}
+	}
+	b.persist(r.Context(), key, item, bodyBytesClean, fill.handOver())
+}
+
+// load returns stored item and its key, variant of item is loaded if primary key points to variants
+func (b *cacheBehavior) load(ctx context.Context, r *http.Request, primaryKey string) (string, *cache.Item) {
+	item := b.cache.Get(ctx, primaryKey)
+	if item == nil || !item.HasVariants() {
+		return primaryKey, item
+	}
+	variantKey := b.cacheKeyConfig.ApplyVary(primaryKey, r, item.Vary)
+	return variantKey, b.cache.Get(ctx, variantKey)
+}
+
+// storageKey is where response is persisted, variant key is equal to primary key if response does not vary
+type storageKey struct {
+	primary string
+	variant string
+	vary    []string
+}
+
+func (b *cacheBehavior) storageKey(r *http.Request, primaryKey string, vary []string) storageKey {
+	if len(vary) == 0 {
+		return storageKey{primary: primaryKey, variant: primaryKey}
+	}
+	return storageKey{primary: primaryKey, variant: b.cacheKeyConfig.ApplyVary(primaryKey, r, vary), vary: vary}
+}
+
+// revalidateInBackground refreshes stored item by background job, item is replaced only if it is not changed meanwhile
+func (b *cacheBehavior) revalidateInBackground(r *http.Request, log *zap.Logger, primaryKey string, cacheKey string, cacheItem *cache.Item) {
+	b.pool.submit(&backgroundJob{kind: backgroundJobRevalidation, key: cacheKey, run: func() {
+		cacheIsInvalidated := false
+		log := log.With(zap.String("goroutine", "invalidation"))
+		// job runs after handler is finished, so context of request is already canceled
+		r, cancel := detachedRequest(r, b.config.Background.requestTimeout())
+		defer cancel()
+		release, locked := b.lockRevalidation(r.Context(), cacheKey)
+		if !locked {
+			log.Debug("stale cache is invalidated by other replica")
+			return
+		}
+		defer func() {
+			release(cacheIsInvalidated)
+			log.With(zap.Bool("is_invalidated", cacheIsInvalidated)).Debug("stale cache invalidated")
+		}()
+		upstreamRequest, conditional := revalidationRequest(r, cacheItem)
+		upstreamRequest = fullObjectRequest(getRequest(upstreamRequest))
+		fetchStart := time.Now()
+		response, err := b.upstream.Do(upstreamRequest)
+		if err != nil {
+			log.With(zap.Error(err)).Error("upstream error")
+			return
+		}
+		defer response.Body.Close()
+		cacheIsInvalidated = b.refreshFromResponse(r.Context(), log, primaryKey, cacheKey, cacheItem, upstreamRequest, conditional, response, fetchStart)
+	}})
+}
+
+// refreshFromLateResponse refills cache in background by response which was too slow for client
+func (b *cacheBehavior) refreshFromLateResponse(
+	ctx context.Context,
+	log *zap.Logger,
+	primaryKey string,
+	cacheKey string,
+	cacheItem *cache.Item,
+	upstreamRequest *http.Request,
+	conditional bool,
+	response *http.Response,
+	err error,
+	canPersistCache bool,
+	fetchStart time.Time,
+	release func(success bool),
+) {
+	log = log.With(zap.String("goroutine", "slow_refresh"))
+	if err != nil {
+		release(false)
+		log.With(zap.Error(err)).Error("upstream error")
+		return
+	}
+	if !canPersistCache {
+		release(false)
+		_ = response.Body.Close()
+		return
+	}
+	b.pool.submit(&backgroundJob{
+		kind: backgroundJobRevalidation,
+		key:  cacheKey,
+		drop: func() {
+			release(false)
+			_ = response.Body.Close()
+		},
+		run: func() {
+			defer response.Body.Close()
+			cacheIsInvalidated := b.refreshFromResponse(ctx, log, primaryKey, cacheKey, cacheItem, upstreamRequest, conditional, response, fetchStart)
+			release(cacheIsInvalidated)
+			log.With(zap.Bool("is_invalidated", cacheIsInvalidated)).Debug("stale cache invalidated")
+		},
+	})
+}
+
+// refreshFromResponse replaces stored item by upstream response if it is cachable, returns true if item is refreshed
+func (b *cacheBehavior) refreshFromResponse(
+	ctx context.Context,
+	log *zap.Logger,
+	primaryKey string,
+	cacheKey string,
+	cacheItem *cache.Item,
+	upstreamRequest *http.Request,
+	conditional bool,
+	response *http.Response,
+	fetchStart time.Time,
+) bool {
+	log = log.With(zap.Int("upstream_status", response.StatusCode))
+	if conditional {
+		metrics.CacheRevalidations.WithLabelValues(revalidationResult(response.StatusCode)).Inc()
+	}
+	if conditional && response.StatusCode == http.StatusNotModified {
+		item := b.revalidatedItem(upstreamRequest, response, cacheItem, time.Since(fetchStart))
+		return b.saveRevalidated(ctx, upstreamRequest, primaryKey, cacheKey, cacheItem, item)
+	}
+	if response.StatusCode != 200 || upstreamRequest.Method != http.MethodGet {
+		log.Warn("not cachable status code")
+		return false
+	}
+	if reason := b.config.objectSizeSkipReason(response.ContentLength); reason != "" {
+		skipObject(log, reason)
+		return false
+	}
+	cacheBytesBuffer := pool.DefaultBufferPool.Get(max(pool.DefaultBufferPoolMinSize, int(response.ContentLength)))
+	defer func() {
+		pool.DefaultBufferPool.Put(cacheBytesBuffer[:0])
+	}()
+	buffer := bytes.NewBuffer(cacheBytesBuffer)
+	if _, err := buffer.ReadFrom(b.config.maxObjectReader(response.Body)); err != nil {
+		log.With(zap.Error(err)).Error("cant read upstream body")
+		return false
+	}
+	if reason := b.config.objectSizeSkipReason(int64(buffer.Len())); reason != "" {
+		skipObject(log, reason)
+		return false
+	}
+	cacheControl := b.cacheControlParser.GetCacheControl(upstreamRequest, response)
+	vary, varyCachable := b.config.Vary.headers(response.Header)
+	if !cacheControl.ShouldCDNPersist() || !varyCachable {
+		return false
+	}
+	item := cache.ItemFromResponse(response, cacheControl, buffer.Bytes())
+	if item == nil {
+		return false
+	}
+	item.FetchDuration = time.Since(fetchStart)
+	// origin could change vary headers, so key is computed by refreshed response
+	key := b.storageKey(upstreamRequest, primaryKey, vary)
+	b.saveVariantsPointer(ctx, key, item)
+	b.cache.Set(ctx, key.variant, b.withEncoded(item), cache.WriteCompareAndSwap)
+	return true
+}
+
+// saveRevalidated saves item revalidated by 304 response, returns false if item is not cachable.
+// Item is moved to other key if origin changed vary headers.
+func (b *cacheBehavior) saveRevalidated(
+	ctx context.Context,
+	upstreamRequest *http.Request,
+	primaryKey string,
+	cacheKey string,
+	cacheItem *cache.Item,
+	item *cache.Item,
+) bool {
+	vary, varyCachable := b.config.Vary.headers(item.Headers)
+	if !item.CacheHeader.ShouldCDNPersist() || !varyCachable {
+		return false
+	}
+	key := b.storageKey(upstreamRequest, primaryKey, vary)
+	b.saveVariantsPointer(ctx, key, item)
+	if key.variant != cacheKey {
+		b.cache.Set(ctx, key.variant, b.withEncoded(item), cache.WriteCompareAndSwap)
+		return true
+	}
+	b.cache.Refresh(ctx, cacheKey, item, cacheItem.SavedAt)
+	return true
+}
+
+// saveVariantsPointer points primary key to variants, pointer lives as long as the latest saved variant
+func (b *cacheBehavior) saveVariantsPointer(ctx context.Context, key storageKey, item *cache.Item) {
+	if len(key.vary) > 0 {
+		b.cache.Set(ctx, key.primary, item.VariantsPointer(key.vary), cache.WriteOverwrite)
+	}
+}
+
+// persist saves item in background, release is called when item is not needed anymore (even if job is dropped),
+// unlock releases revalidation lock after item is saved.
+// Varied item is saved by variant key, primary key points to variants.
+func (b *cacheBehavior) persist(
+	ctx context.Context,
+	key storageKey,
+	item *cache.Item,
+	release func(),
+	unlock func(success bool),
+) {
+	drop := func() {
+		release()
+		unlock(false)
+	}
+	b.pool.submit(&backgroundJob{kind: backgroundJobCacheSaving, drop: drop, run: func() {
 		cacheIsSaved := false
-		log = log.With(zap.String("goroutine", "cache_saving"))
+		log := logger.FromCtx(ctx).
+			With(zap.String("component", "cacheBehavior")).
+			With(zap.String("goroutine", "cache_saving"))
 		defer func() {
 			log.With(zap.Bool("is_saved", cacheIsSaved)).Debug("persist cache")
 		}()
-		defer bodyBytesClean()
-		cacheItem = cache.ItemFromResponse(response, cacheControl, bodyBuffer.Bytes())
-		if cacheItem == nil {
+		defer release()
+		if item == nil {
+			unlock(false)
 			return
 		}
-		b.cache.Set(ctx, b.cacheKeyConfig.Apply(r), cacheItem)
+		b.saveVariantsPointer(ctx, key, item)
+		// fill always carries the newest item, so stale item is replaced, but item saved meanwhile by someone else is kept.
+		// Stale item could be stored even if it is not loaded (can_load_cache is false)
+		b.cache.Set(ctx, key.variant, b.withEncoded(item), cache.WriteCompareAndSwap)
 		cacheIsSaved = true
-	}()
+		unlock(true)
+	}})
+}
+
+// revalidationRequest returns conditional request for full object with validators of stored item,
+// or origin request if item have no validators
+func revalidationRequest(r *http.Request, item *cache.Item) (*http.Request, bool) {
+	request := r.Clone(r.Context())
+	if !item.SetValidators(request.Header) {
+		return r, false
+	}
+	request.Header.Del("Range")
+	return request, true
+}
+
+func (b *cacheBehavior) revalidatedItem(upstreamRequest *http.Request, response *http.Response, item *cache.Item, fetchDuration time.Duration) *cache.Item {
+	headers := item.MergeHeaders(response.Header)
+	cacheControl := b.cacheControlParser.GetCacheControl(upstreamRequest, &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     headers,
+	})
+	revalidated := item.Revalidated(headers, cacheControl)
+	revalidated.FetchDuration = fetchDuration
+	return revalidated
+}
+
+func revalidationResult(statusCode int) string {
+	return metrics.BoolToString(statusCode == http.StatusNotModified, "not_modified", "modified")
 }
 
 func ioCopy(dst io.Writer, src io.Reader) error {
@@ -228,12 +599,13 @@ func ioCopy(dst io.Writer, src io.Reader) error {
 	return err
 }
 
-func ioCopyWithPersist(dst io.Writer, src io.Reader, buffer *bytes.Buffer) error {
-	if _, err := buffer.ReadFrom(src); err != nil {
-		return err
+func proxyResponse(w http.ResponseWriter, response *http.Response, cacheStatus string, log *zap.Logger) {
+	copyHeaders(response.Header, w.Header())
+	w.Header().Set("X-Cache-Status", cacheStatus)
+	w.WriteHeader(response.StatusCode)
+	if err := ioCopy(w, response.Body); err != nil {
+		log.With(zap.Error(err)).Warn("cant write response body")
 	}
-	_, err := dst.Write(buffer.Bytes())
-	return err
 }
 
 func copyHeaders(from, to http.Header) {
@@ -4,41 +4,54 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
 	"github.com/paragor/simple_cdn/pkg/cache"
+	"github.com/paragor/simple_cdn/pkg/compression"
 	"github.com/paragor/simple_cdn/pkg/logger"
 	"github.com/paragor/simple_cdn/pkg/metrics"
+	"github.com/paragor/simple_cdn/pkg/upstream"
 	"github.com/paragor/simple_cdn/pkg/user"
 	"go.uber.org/zap/zapcore"
 	"io"
+	"maps"
 	"net/http"
 	"net/http/httptest"
 	"net/textproto"
 	"regexp"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 // newInMemoryCache only for tests
 func newInMemoryCache() *inMemoryCache {
-	return &inMemoryCache{data: make(map[string]*cache.Item)}
+	return &inMemoryCache{data: make(map[string]*cache.Item), locks: make(map[string]time.Time)}
 }
 
 // inMemoryCache only for tests
 type inMemoryCache struct {
-	m           sync.Mutex
-	data        map[string]*cache.Item
-	savingCount int
-	wait        sync.Cond
+	m            sync.Mutex
+	data         map[string]*cache.Item
+	savingCount  int
+	refreshCount int
+	encodedCount int
+	locks        map[string]time.Time
+	wait         sync.Cond
 }
 
 func (c *inMemoryCache) With(r *http.Request, keyConfig *cache.KeyConfig, value *cache.Item) *inMemoryCache {
-	c.Set(context.Background(), keyConfig.Apply(r), value)
+	c.Set(context.Background(), keyConfig.Apply(r), value, cache.WriteOverwrite)
 	return c
 }
 
+// Get returns item without encoded bodies like redis, they are fetched by GetEncoded
 func (c *inMemoryCache) Get(_ context.Context, key string) *cache.Item {
 	c.m.Lock()
 	value, ok := c.data[key]
@@ -46,7 +59,26 @@ func (c *inMemoryCache) Get(_ context.Context, key string) *cache.Item {
 	if !ok {
 		return nil
 	}
-	return value
+	withoutEncoded := *value
+	withoutEncoded.Encoded = nil
+	return &withoutEncoded
+}
+
+// Stored returns item with encoded bodies
+func (c *inMemoryCache) Stored(key string) *cache.Item {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.data[key]
+}
+
+func (c *inMemoryCache) GetEncoded(_ context.Context, key string, savedAt time.Time, encoding string) []byte {
+	c.m.Lock()
+	defer c.m.Unlock()
+	stored, ok := c.data[key]
+	if !ok || !stored.SavedAt.Equal(savedAt) {
+		return nil
+	}
+	return stored.Encoded[encoding]
 }
 
 func (c *inMemoryCache) Len() int {
@@ -60,11 +92,88 @@ func (c *inMemoryCache) SavingCount() int {
 	return c.savingCount
 }
 
-func (c *inMemoryCache) Set(_ context.Context, key string, value *cache.Item) {
+func (c *inMemoryCache) Set(_ context.Context, key string, value *cache.Item, mode cache.WriteMode) {
 	c.m.Lock()
+	defer c.m.Unlock()
 	c.savingCount++
+	if stored, ok := c.data[key]; ok {
+		if mode == cache.WriteInsert {
+			return
+		}
+		if mode == cache.WriteCompareAndSwap && !stored.SavedAt.Before(value.SavedAt) {
+			return
+		}
+	}
+	// body could be pooled buffer, real cache serializes it
+	stored := *value
+	stored.Body = bytes.Clone(value.Body)
+	c.data[key] = &stored
+}
+
+func (c *inMemoryCache) RefreshCount() int {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.refreshCount
+}
+
+func (c *inMemoryCache) Refresh(_ context.Context, key string, value *cache.Item, revalidatedSavedAt time.Time) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if stored, ok := c.data[key]; !ok || !stored.SavedAt.Equal(revalidatedSavedAt) {
+		return
+	}
+	c.refreshCount++
 	c.data[key] = value
-	c.m.Unlock()
+}
+
+func (c *inMemoryCache) SetEncoded(_ context.Context, key string, savedAt time.Time, encoding string, body []byte) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	stored, ok := c.data[key]
+	if !ok || !stored.SavedAt.Equal(savedAt) {
+		return
+	}
+	c.encodedCount++
+	withEncoded := *stored
+	withEncoded.Encoded = maps.Clone(stored.Encoded)
+	if withEncoded.Encoded == nil {
+		withEncoded.Encoded = map[string][]byte{}
+	}
+	withEncoded.Encoded[encoding] = bytes.Clone(body)
+	c.data[key] = &withEncoded
+}
+
+func (c *inMemoryCache) EncodedCount() int {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.encodedCount
+}
+
+func (c *inMemoryCache) TryLock(ctx context.Context, key string, ttl time.Duration) (func(), bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	if deadline, ok := c.locks[key]; ok && time.Now().Before(deadline) {
+		return nil, false, nil
+	}
+	deadline := time.Now().Add(ttl)
+	c.locks[key] = deadline
+	return func() {
+		c.m.Lock()
+		defer c.m.Unlock()
+		if c.locks[key] == deadline {
+			delete(c.locks, key)
+		}
+	}, true, nil
+}
+
+func (c *inMemoryCache) Locked(key string) bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+	deadline, ok := c.locks[key]
+	return ok && time.Now().Before(deadline)
 }
 
 func (c *inMemoryCache) Invalidate(_ context.Context, keyPattern string) error {
@@ -192,6 +301,7 @@ func Test_cacheBehavior_ServeHTTP_ProxyPass(t *testing.T) {
 		fUpstream,
 		fCache,
 		&cacheControlParser,
+		&Config{},
 	)
 	fBody := bytes.NewBuffer(nil)
 	fBody.WriteString("this is body")
@@ -313,6 +423,1320 @@ func Test_cacheBehavior_ServeHTTP_ProxyPass(t *testing.T) {
 	}
 }
 
+func Test_cacheBehavior_ServeHTTP_Revalidation(t *testing.T) {
+	initMetricsAndLogs()
+	keyConfig := &cache.KeyConfig{AllQuery: true}
+	fBody := []byte("this is body")
+	staleRequest := createRequest(http.MethodGet, "http://127.0.0.1/stale", nil, nil, nil)
+	expiredRequest := createRequest(http.MethodGet, "http://127.0.0.1/expired", nil, nil, nil)
+	cacheControl := cache.CacheControl{
+		Public:               true,
+		SMaxAge:              time.Minute,
+		StaleWhileRevalidate: time.Hour,
+		StaleIfError:         3 * time.Hour,
+	}
+	fCache := newInMemoryCache().
+		With(staleRequest, keyConfig, &cache.Item{
+			SavedAt:     time.Now().Add(-10 * time.Minute),
+			CacheHeader: cacheControl,
+			Headers:     http.Header{"Etag": {`"v1"`}},
+			Body:        fBody,
+		}).
+		With(expiredRequest, keyConfig, &cache.Item{
+			SavedAt:     time.Now().Add(-2 * time.Hour),
+			CacheHeader: cacheControl,
+			Headers:     http.Header{"Last-Modified": {"Mon, 02 Jan 2006 15:04:05 GMT"}},
+			Body:        fBody,
+		})
+	notModified := func(request *http.Request) (*http.Response, error) {
+		if request.Header.Get("If-None-Match") == "" && request.Header.Get("If-Modified-Since") == "" {
+			t.Error("upstream request is not conditional")
+		}
+		return createResponse(http.StatusNotModified, http.Header{"Cache-Control": {"public, s-maxage=60, stale-while-revalidate=3600"}}, nil), nil
+	}
+	fUpstream := newFakeUpstream().
+		WithOrdered(notModified).
+		WithOrdered(notModified).
+		WithAny(func(request *http.Request) (*http.Response, error) {
+			t.Error("unexpected call upstream")
+			return nil, fmt.Errorf("unexpected call upstream")
+		})
+	cachebehavior := NewCacheBehavior(
+		user.Always(),
+		user.Always(),
+		keyConfig,
+		fUpstream,
+		fCache,
+		&orderedCacheControlFallback{},
+		&Config{},
+	)
+
+	for _, tt := range []struct {
+		request     *http.Request
+		cacheStatus string
+	}{
+		{request: staleRequest, cacheStatus: "HIT-STALE"},
+		{request: expiredRequest, cacheStatus: "REVALIDATED"},
+	} {
+		start := fCache.RefreshCount()
+		recorder := httptest.NewRecorder()
+		cachebehavior.ServeHTTP(recorder, tt.request)
+		if recorder.Code != 200 {
+			t.Errorf("%s wrong status code: expected %d, got %d", tt.cacheStatus, 200, recorder.Code)
+		}
+		if got := recorder.Header().Get("X-Cache-Status"); got != tt.cacheStatus {
+			t.Errorf("wrong cache status: expected %s, got %s", tt.cacheStatus, got)
+		}
+		if recorder.Body.String() != string(fBody) {
+			t.Errorf("%s wrong body: expected '%s', got '%s'", tt.cacheStatus, string(fBody), recorder.Body.String())
+		}
+		timeout := time.NewTimer(time.Second)
+		for fCache.RefreshCount() == start {
+			select {
+			case <-timeout.C:
+				t.Fatalf("%s no expected cache refresh", tt.cacheStatus)
+			case <-time.After(time.Millisecond * 10):
+			}
+		}
+		item := fCache.Get(context.Background(), keyConfig.Apply(tt.request))
+		if !item.CanUseCache(time.Now()) {
+			t.Errorf("%s item is not refreshed", tt.cacheStatus)
+		}
+		if string(item.Body) != string(fBody) {
+			t.Errorf("%s wrong refreshed body: expected '%s', got '%s'", tt.cacheStatus, string(fBody), string(item.Body))
+		}
+	}
+}
+
+func Test_cacheBehavior_ServeHTTP_StaleOverwrite(t *testing.T) {
+	initMetricsAndLogs()
+	keyConfig := &cache.KeyConfig{AllQuery: true}
+	staleRequest := createRequest(http.MethodGet, "http://127.0.0.1/stale", nil, nil, nil)
+	fCache := newInMemoryCache().
+		With(staleRequest, keyConfig, &cache.Item{
+			SavedAt:     time.Now().Add(-10 * time.Minute),
+			CacheHeader: cache.CacheControl{Public: true, SMaxAge: time.Minute, StaleWhileRevalidate: time.Hour},
+			Body:        []byte("old body"),
+		})
+	fUpstream := newFakeUpstream().
+		WithOrdered(func(request *http.Request) (*http.Response, error) {
+			return createResponse(200, http.Header{"Cache-Control": {"public, s-maxage=60"}}, []byte("new body")), nil
+		}).
+		WithAny(func(request *http.Request) (*http.Response, error) {
+			t.Error("unexpected call upstream")
+			return nil, fmt.Errorf("unexpected call upstream")
+		})
+	cachebehavior := NewCacheBehavior(
+		user.Always(),
+		user.Always(),
+		keyConfig,
+		fUpstream,
+		fCache,
+		&orderedCacheControlFallback{},
+		&Config{},
+	)
+	recorder := httptest.NewRecorder()
+	cachebehavior.ServeHTTP(recorder, staleRequest)
+	if recorder.Body.String() != "old body" {
+		t.Errorf("wrong body: expected '%s', got '%s'", "old body", recorder.Body.String())
+	}
+	timeout := time.NewTimer(time.Second)
+	for fCache.SavingCount() != 2 {
+		select {
+		case <-timeout.C:
+			t.Fatal("no expected cache savings")
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+	if item := fCache.Get(context.Background(), keyConfig.Apply(staleRequest)); string(item.Body) != "new body" {
+		t.Errorf("stale item should be overwritten, got body '%s'", string(item.Body))
+	}
+}
+
+func Test_cacheBehavior_ServeHTTP_StaleOverwriteWithoutLoad(t *testing.T) {
+	initMetricsAndLogs()
+	keyConfig := &cache.KeyConfig{AllQuery: true}
+	request := createRequest(http.MethodGet, "http://127.0.0.1/warm", nil, nil, nil)
+	fCache := newInMemoryCache().
+		With(request, keyConfig, &cache.Item{
+			SavedAt:     time.Now().Add(-10 * time.Minute),
+			CacheHeader: cache.CacheControl{Public: true, SMaxAge: time.Minute},
+			Body:        []byte("old body"),
+		})
+	fUpstream := newFakeUpstream().
+		WithAny(func(request *http.Request) (*http.Response, error) {
+			return createResponse(200, http.Header{"Cache-Control": {"public, s-maxage=60"}}, []byte("new body")), nil
+		})
+	// cache warmer refreshes items without loading them
+	cachebehavior := NewCacheBehavior(
+		user.Always(),
+		user.Never(),
+		keyConfig,
+		fUpstream,
+		fCache,
+		&orderedCacheControlFallback{},
+		&Config{},
+	)
+	recorder := httptest.NewRecorder()
+	cachebehavior.ServeHTTP(recorder, request)
+	if recorder.Body.String() != "new body" {
+		t.Errorf("wrong body: expected '%s', got '%s'", "new body", recorder.Body.String())
+	}
+	timeout := time.NewTimer(time.Second)
+	for fCache.SavingCount() != 2 {
+		select {
+		case <-timeout.C:
+			t.Fatal("no expected cache savings")
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+	if item := fCache.Get(context.Background(), keyConfig.Apply(request)); string(item.Body) != "new body" {
+		t.Errorf("stale item should be overwritten, got body '%s'", string(item.Body))
+	}
+}
+
+func Test_cacheBehavior_ServeHTTP_EarlyRefresh(t *testing.T) {
+	initMetricsAndLogs()
+	keyConfig := &cache.KeyConfig{AllQuery: true}
+	request := createRequest(http.MethodGet, "http://127.0.0.1/almost_expired", nil, nil, nil)
+	fCache := newInMemoryCache().
+		With(request, keyConfig, &cache.Item{
+			SavedAt:       time.Now().Add(-59 * time.Second),
+			CacheHeader:   cache.CacheControl{Public: true, SMaxAge: time.Minute},
+			Body:          []byte("old body"),
+			FetchDuration: time.Hour,
+		})
+	fUpstream := newFakeUpstream().
+		WithOrdered(func(request *http.Request) (*http.Response, error) {
+			return createResponse(200, http.Header{"Cache-Control": {"public, s-maxage=60"}}, []byte("new body")), nil
+		}).
+		WithAny(func(request *http.Request) (*http.Response, error) {
+			t.Error("unexpected call upstream")
+			return nil, fmt.Errorf("unexpected call upstream")
+		})
+	cachebehavior := NewCacheBehavior(
+		user.Always(),
+		user.Always(),
+		keyConfig,
+		fUpstream,
+		fCache,
+		&orderedCacheControlFallback{},
+		&Config{EarlyRefresh: EarlyRefreshConfig{Enabled: true}},
+	)
+	recorder := httptest.NewRecorder()
+	cachebehavior.ServeHTTP(recorder, request)
+	if recorder.Body.String() != "old body" || recorder.Header().Get("X-Cache-Status") != "HIT" {
+		t.Errorf("wrong response: expected HIT '%s', got %s '%s'", "old body", recorder.Header().Get("X-Cache-Status"), recorder.Body.String())
+	}
+	timeout := time.NewTimer(time.Second)
+	for fCache.SavingCount() != 2 {
+		select {
+		case <-timeout.C:
+			t.Fatal("no expected early refresh")
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+	item := fCache.Get(context.Background(), keyConfig.Apply(request))
+	if string(item.Body) != "new body" {
+		t.Errorf("item should be refreshed early, got body '%s'", string(item.Body))
+	}
+	if item.FetchDuration <= 0 || item.FetchDuration >= time.Hour {
+		t.Errorf("fetch duration of refreshed item should be measured, got %s", item.FetchDuration)
+	}
+}
+
+func Test_cacheBehavior_ServeHTTP_StaleIfSlow(t *testing.T) {
+	initMetricsAndLogs()
+	keyConfig := &cache.KeyConfig{AllQuery: true}
+	tests := []struct {
+		name        string
+		delay       time.Duration
+		cacheStatus string
+		body        string
+	}{
+		{name: "slow upstream", delay: 200 * time.Millisecond, cacheStatus: "HIT-SLOW", body: "old body"},
+		{name: "fast upstream", delay: 0, cacheStatus: "MISS", body: "new body"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := createRequest(http.MethodGet, "http://127.0.0.1/slow", nil, nil, nil)
+			fCache := newInMemoryCache().
+				With(request, keyConfig, &cache.Item{
+					SavedAt:     time.Now().Add(-10 * time.Minute),
+					CacheHeader: cache.CacheControl{Public: true, SMaxAge: time.Minute, StaleIfError: time.Hour},
+					Body:        []byte("old body"),
+				})
+			fUpstream := newFakeUpstream().
+				WithOrdered(func(request *http.Request) (*http.Response, error) {
+					time.Sleep(tt.delay)
+					return createResponse(200, http.Header{"Cache-Control": {"public, s-maxage=60"}}, []byte("new body")), nil
+				}).
+				WithAny(func(request *http.Request) (*http.Response, error) {
+					t.Error("unexpected call upstream")
+					return nil, fmt.Errorf("unexpected call upstream")
+				})
+			cachebehavior := NewCacheBehavior(
+				user.Always(),
+				user.Always(),
+				keyConfig,
+				fUpstream,
+				fCache,
+				&orderedCacheControlFallback{},
+				&Config{StaleIfSlow: StaleIfSlowConfig{Budget: 20 * time.Millisecond}},
+			)
+			recorder := httptest.NewRecorder()
+			cachebehavior.ServeHTTP(recorder, request)
+			if recorder.Header().Get("X-Cache-Status") != tt.cacheStatus {
+				t.Errorf("wrong cache status: expected '%s', got '%s'", tt.cacheStatus, recorder.Header().Get("X-Cache-Status"))
+			}
+			if recorder.Body.String() != tt.body {
+				t.Errorf("wrong body: expected '%s', got '%s'", tt.body, recorder.Body.String())
+			}
+			timeout := time.NewTimer(time.Second)
+			for fCache.SavingCount() != 2 {
+				select {
+				case <-timeout.C:
+					t.Fatal("no expected cache savings")
+				case <-time.After(time.Millisecond * 10):
+				}
+			}
+			if item := fCache.Get(context.Background(), keyConfig.Apply(request)); string(item.Body) != "new body" {
+				t.Errorf("stale item should be refilled, got body '%s'", string(item.Body))
+			}
+		})
+	}
+}
+
+func Test_cacheBehavior_ServeHTTP_Vary(t *testing.T) {
+	initMetricsAndLogs()
+	keyConfig := &cache.KeyConfig{AllQuery: true}
+	languageRequest := func(language string) *http.Request {
+		return createRequest(http.MethodGet, "http://127.0.0.1/page", http.Header{"Accept-Language": {language}}, nil, nil)
+	}
+	languageResponse := func(request *http.Request) (*http.Response, error) {
+		return createResponse(200, http.Header{
+			"Cache-Control": {"public, s-maxage=60"},
+			"Vary":          {"Accept-Encoding, Accept-Language"},
+		}, []byte(request.Header.Get("Accept-Language"))), nil
+	}
+	fCache := newInMemoryCache()
+	fUpstream := newFakeUpstream().
+		WithOrdered(languageResponse).
+		WithOrdered(languageResponse).
+		WithOrdered(func(request *http.Request) (*http.Response, error) {
+			return createResponse(200, http.Header{
+				"Cache-Control": {"public, s-maxage=60"},
+				"Vary":          {"*"},
+			}, []byte("star")), nil
+		}).
+		WithAny(func(request *http.Request) (*http.Response, error) {
+			t.Error("unexpected call upstream")
+			return nil, fmt.Errorf("unexpected call upstream")
+		})
+	cachebehavior := NewCacheBehavior(
+		user.Always(),
+		user.Always(),
+		keyConfig,
+		fUpstream,
+		fCache,
+		&orderedCacheControlFallback{},
+		&Config{},
+	)
+	tests := []struct {
+		request     *http.Request
+		savings     int
+		cacheStatus string
+		body        string
+	}{
+		{request: languageRequest("en"), savings: 2, cacheStatus: "MISS", body: "en"},
+		{request: languageRequest("ru"), savings: 4, cacheStatus: "MISS", body: "ru"},
+		{request: languageRequest("en"), savings: 4, cacheStatus: "HIT", body: "en"},
+		{request: languageRequest("ru"), savings: 4, cacheStatus: "HIT", body: "ru"},
+		{request: createRequest(http.MethodGet, "http://127.0.0.1/star", nil, nil, nil), savings: 4, cacheStatus: "MISS", body: "star"},
+	}
+	for _, tt := range tests {
+		recorder := httptest.NewRecorder()
+		cachebehavior.ServeHTTP(recorder, tt.request)
+		if recorder.Header().Get("X-Cache-Status") != tt.cacheStatus {
+			t.Errorf("%s wrong cache status: expected '%s', got '%s'", tt.body, tt.cacheStatus, recorder.Header().Get("X-Cache-Status"))
+		}
+		if recorder.Body.String() != tt.body {
+			t.Errorf("wrong body: expected '%s', got '%s'", tt.body, recorder.Body.String())
+		}
+		timeout := time.NewTimer(time.Second)
+		for fCache.SavingCount() != tt.savings {
+			select {
+			case <-timeout.C:
+				t.Fatalf("%s no expected cache savings: expected %d, got %d", tt.body, tt.savings, fCache.SavingCount())
+			case <-time.After(time.Millisecond * 10):
+			}
+		}
+	}
+	if fCache.Len() != 3 {
+		t.Errorf("expected pointer and two variants in cache, got %d items", fCache.Len())
+	}
+}
+
+func Test_cacheBehavior_ServeHTTP_VaryRevalidation(t *testing.T) {
+	initMetricsAndLogs()
+	keyConfig := &cache.KeyConfig{AllQuery: true}
+	cacheControl := cache.CacheControl{Public: true, SMaxAge: time.Minute, StaleWhileRevalidate: time.Hour}
+	savedAt := time.Now().Add(-10 * time.Minute)
+	for _, tt := range []struct {
+		name         string
+		responseVary string
+		wantVary     []string
+	}{
+		{name: "the same vary", responseVary: "Accept-Language", wantVary: []string{"accept-language"}},
+		{name: "changed vary", responseVary: "Accept-Language, X-Device", wantVary: []string{"accept-language", "x-device"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			request := createRequest(http.MethodGet, "http://127.0.0.1/page", http.Header{
+				"Accept-Language": {"en"},
+				"X-Device":        {"mobile"},
+			}, nil, nil)
+			primaryKey := keyConfig.Apply(request)
+			variantKey := keyConfig.ApplyVary(primaryKey, request, []string{"accept-language"})
+			variant := &cache.Item{
+				SavedAt:     savedAt,
+				CacheHeader: cacheControl,
+				Headers:     http.Header{"Etag": {`"v1"`}, "Vary": {"Accept-Language"}},
+				Body:        []byte("en"),
+			}
+			fCache := newInMemoryCache()
+			fCache.Set(context.Background(), primaryKey, variant.VariantsPointer([]string{"accept-language"}), cache.WriteOverwrite)
+			fCache.Set(context.Background(), variantKey, variant, cache.WriteOverwrite)
+			fUpstream := newFakeUpstream().
+				WithAny(func(request *http.Request) (*http.Response, error) {
+					return createResponse(http.StatusNotModified, http.Header{
+						"Cache-Control": {"public, s-maxage=60, stale-while-revalidate=3600"},
+						"Vary":          {tt.responseVary},
+					}, nil), nil
+				})
+			cachebehavior := NewCacheBehavior(
+				user.Always(),
+				user.Always(),
+				keyConfig,
+				fUpstream,
+				fCache,
+				&orderedCacheControlFallback{},
+				&Config{},
+			)
+			recorder := httptest.NewRecorder()
+			cachebehavior.ServeHTTP(recorder, request)
+			if got := recorder.Header().Get("X-Cache-Status"); got != "HIT-STALE" {
+				t.Errorf("wrong cache status: expected %s, got %s", "HIT-STALE", got)
+			}
+			refreshedKey := keyConfig.ApplyVary(primaryKey, request, tt.wantVary)
+			timeout := time.NewTimer(time.Second)
+			for item := fCache.Get(context.Background(), refreshedKey); item == nil || item.SavedAt.Equal(savedAt); item = fCache.Get(context.Background(), refreshedKey) {
+				select {
+				case <-timeout.C:
+					t.Fatal("variant is not refreshed")
+				case <-time.After(time.Millisecond * 10):
+				}
+			}
+			if item := fCache.Get(context.Background(), refreshedKey); string(item.Body) != "en" {
+				t.Errorf("wrong body of variant: expected 'en', got '%s'", string(item.Body))
+			}
+			pointer := fCache.Get(context.Background(), primaryKey)
+			if pointer.SavedAt.Equal(savedAt) {
+				t.Error("pointer of variants is not refreshed")
+			}
+			if !slices.Equal(pointer.Vary, tt.wantVary) {
+				t.Errorf("wrong vary of pointer: expected %v, got %v", tt.wantVary, pointer.Vary)
+			}
+		})
+	}
+}
+
+func Test_cacheBehavior_ServeHTTP_Compression(t *testing.T) {
+	initMetricsAndLogs()
+	keyConfig := &cache.KeyConfig{AllQuery: true}
+	body := bytes.Repeat([]byte("<html>hello world</html>"), 100)
+	fCache := newInMemoryCache()
+	fUpstream := newFakeUpstream().
+		WithOrdered(func(request *http.Request) (*http.Response, error) {
+			return createResponse(200, http.Header{
+				"Cache-Control": {"public, s-maxage=60"},
+				"Content-Type":  {"text/html; charset=utf-8"},
+				"Etag":          {`"v1"`},
+			}, body), nil
+		}).
+		WithOrdered(func(request *http.Request) (*http.Response, error) {
+			return createResponse(200, http.Header{
+				"Cache-Control": {"public, s-maxage=60"},
+				"Content-Type":  {"image/png"},
+			}, body), nil
+		}).
+		WithAny(func(request *http.Request) (*http.Response, error) {
+			t.Error("unexpected call upstream")
+			return nil, fmt.Errorf("unexpected call upstream")
+		})
+	cachebehavior := NewCacheBehavior(
+		user.Always(),
+		user.Always(),
+		keyConfig,
+		fUpstream,
+		fCache,
+		&orderedCacheControlFallback{},
+		&Config{Compression: CompressionConfig{Enabled: true, MinSize: 1024, StoreEncoded: true}},
+	)
+	decode := func(encoding string, data []byte) []byte {
+		switch encoding {
+		case "":
+			return data
+		case compression.Gzip:
+			return must1(io.ReadAll(must1(gzip.NewReader(bytes.NewReader(data)))))
+		case compression.Brotli:
+			return must1(io.ReadAll(brotli.NewReader(bytes.NewReader(data))))
+		case compression.Zstd:
+			return must1(io.ReadAll(must1(zstd.NewReader(bytes.NewReader(data)))))
+		}
+		t.Fatalf("unexpected encoding %s", encoding)
+		return nil
+	}
+	tests := []struct {
+		path           string
+		acceptEncoding string
+		cacheStatus    string
+		encoding       string
+		vary           bool
+	}{
+		{path: "/page", acceptEncoding: "gzip", cacheStatus: "MISS", encoding: compression.Gzip, vary: true},
+		{path: "/page", acceptEncoding: "gzip, br", cacheStatus: "HIT", encoding: compression.Brotli, vary: true},
+		{path: "/page", acceptEncoding: "gzip, br, zstd", cacheStatus: "HIT", encoding: compression.Zstd, vary: true},
+		{path: "/page", acceptEncoding: "", cacheStatus: "HIT", encoding: "", vary: true},
+		{path: "/image", acceptEncoding: "gzip", cacheStatus: "MISS", encoding: "", vary: false},
+		{path: "/image", acceptEncoding: "gzip", cacheStatus: "HIT", encoding: "", vary: false},
+	}
+	for _, tt := range tests {
+		request := createRequest(http.MethodGet, "http://127.0.0.1"+tt.path, http.Header{"Accept-Encoding": {tt.acceptEncoding}}, nil, nil)
+		recorder := httptest.NewRecorder()
+		cachebehavior.ServeHTTP(recorder, request)
+		name := tt.path + " " + tt.acceptEncoding
+		if recorder.Header().Get("X-Cache-Status") != tt.cacheStatus {
+			t.Errorf("%s wrong cache status: expected '%s', got '%s'", name, tt.cacheStatus, recorder.Header().Get("X-Cache-Status"))
+		}
+		if recorder.Header().Get("Content-Encoding") != tt.encoding {
+			t.Errorf("%s wrong encoding: expected '%s', got '%s'", name, tt.encoding, recorder.Header().Get("Content-Encoding"))
+		}
+		if vary := recorder.Header().Get("Vary") == "Accept-Encoding"; vary != tt.vary {
+			t.Errorf("%s wrong vary: expected %v, got '%s'", name, tt.vary, recorder.Header().Get("Vary"))
+		}
+		if tt.encoding != "" && recorder.Header().Get("Etag") != `W/"v1"` {
+			t.Errorf("%s etag of encoded body should be weak, got '%s'", name, recorder.Header().Get("Etag"))
+		}
+		if !bytes.Equal(decode(tt.encoding, recorder.Body.Bytes()), body) {
+			t.Errorf("%s wrong decoded body", name)
+		}
+		timeout := time.NewTimer(time.Second)
+		for tt.cacheStatus == "MISS" && fCache.Get(context.Background(), keyConfig.Apply(request)) == nil {
+			select {
+			case <-timeout.C:
+				t.Fatalf("%s no expected cache savings", name)
+			case <-time.After(time.Millisecond * 10):
+			}
+		}
+	}
+	page := fCache.Stored(keyConfig.Apply(createRequest(http.MethodGet, "http://127.0.0.1/page", nil, nil, nil)))
+	if len(page.Encoded) != len(compression.Supported) {
+		t.Errorf("encoded bodies should be stored, got %d", len(page.Encoded))
+	}
+}
+
+func Test_cacheBehavior_ServeHTTP_CompressionOnTheFlyIsStored(t *testing.T) {
+	initMetricsAndLogs()
+	keyConfig := &cache.KeyConfig{AllQuery: true}
+	body := bytes.Repeat([]byte("<html>hello world</html>"), 100)
+	request := createRequest(http.MethodGet, "http://127.0.0.1/page", http.Header{"Accept-Encoding": {"gzip"}}, nil, nil)
+	fCache := newInMemoryCache().
+		With(request, keyConfig, &cache.Item{
+			SavedAt:     time.Now(),
+			CacheHeader: cache.CacheControl{Public: true, SMaxAge: time.Hour},
+			Headers:     http.Header{"Content-Type": {"text/html"}},
+			Body:        body,
+		})
+	cachebehavior := NewCacheBehavior(
+		user.Always(),
+		user.Always(),
+		keyConfig,
+		newFakeUpstream(),
+		fCache,
+		&orderedCacheControlFallback{},
+		&Config{Compression: CompressionConfig{Enabled: true, MinSize: 1024}},
+	)
+	for i := 0; i < 3; i++ {
+		recorder := httptest.NewRecorder()
+		cachebehavior.ServeHTTP(recorder, request)
+		if got := recorder.Header().Get("Content-Encoding"); got != compression.Gzip {
+			t.Fatalf("wrong encoding: expected '%s', got '%s'", compression.Gzip, got)
+		}
+		timeout := time.NewTimer(time.Second)
+		for fCache.EncodedCount() != 1 {
+			select {
+			case <-timeout.C:
+				t.Fatal("encoded body is not stored")
+			case <-time.After(time.Millisecond * 10):
+			}
+		}
+	}
+	item := fCache.Stored(keyConfig.Apply(request))
+	if decoded := must1(io.ReadAll(must1(gzip.NewReader(bytes.NewReader(item.Encoded[compression.Gzip]))))); !bytes.Equal(decoded, body) {
+		t.Errorf("wrong stored encoded body")
+	}
+}
+
+// streamingWriter reports every written chunk, it fails writes if broken
+type streamingWriter struct {
+	header http.Header
+	chunks chan string
+	broken bool
+}
+
+func (w *streamingWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *streamingWriter) WriteHeader(int) {}
+
+func (w *streamingWriter) Write(p []byte) (int, error) {
+	if w.broken {
+		return 0, fmt.Errorf("client is gone")
+	}
+	w.chunks <- string(p)
+	return len(p), nil
+}
+
+func Test_cacheBehavior_ServeHTTP_Streaming(t *testing.T) {
+	initMetricsAndLogs()
+	keyConfig := &cache.KeyConfig{AllQuery: true}
+	tests := []struct {
+		name          string
+		maxObjectSize int64
+		brokenClient  bool
+		persisted     bool
+	}{
+		{name: "persisted", persisted: true},
+		{name: "too big", maxObjectSize: 5, persisted: false},
+		{name: "client is gone", brokenClient: true, persisted: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreamBody, upstreamWriter := io.Pipe()
+			fCache := newInMemoryCache()
+			fUpstream := newFakeUpstream().
+				WithOrdered(func(request *http.Request) (*http.Response, error) {
+					return &http.Response{
+						StatusCode:    200,
+						Header:        http.Header{"Cache-Control": {"public, s-maxage=60"}},
+						Body:          upstreamBody,
+						ContentLength: -1,
+					}, nil
+				}).
+				WithAny(func(request *http.Request) (*http.Response, error) {
+					t.Error("unexpected call upstream")
+					return nil, fmt.Errorf("unexpected call upstream")
+				})
+			cachebehavior := NewCacheBehavior(
+				user.Always(),
+				user.Always(),
+				keyConfig,
+				fUpstream,
+				fCache,
+				&orderedCacheControlFallback{},
+				&Config{MaxObjectSize: tt.maxObjectSize},
+			)
+			request := createRequest(http.MethodGet, "http://127.0.0.1/stream", nil, nil, nil)
+			w := &streamingWriter{header: http.Header{}, chunks: make(chan string, 10), broken: tt.brokenClient}
+			served := make(chan struct{})
+			go func() {
+				defer close(served)
+				cachebehavior.ServeHTTP(w, request)
+			}()
+			if _, err := upstreamWriter.Write([]byte("first")); err != nil {
+				t.Fatalf("cant write upstream body: %s", err)
+			}
+			if !tt.brokenClient {
+				select {
+				case chunk := <-w.chunks:
+					if chunk != "first" {
+						t.Errorf("wrong first chunk: '%s'", chunk)
+					}
+				case <-time.After(time.Second):
+					t.Fatal("first chunk is not streamed before upstream body end")
+				}
+				_, _ = upstreamWriter.Write([]byte("second"))
+			}
+			_ = upstreamWriter.Close()
+			<-served
+			timeout := time.NewTimer(100 * time.Millisecond)
+			for tt.persisted && fCache.SavingCount() == 0 {
+				select {
+				case <-timeout.C:
+					t.Fatal("no expected cache savings")
+				case <-time.After(time.Millisecond * 10):
+				}
+			}
+			item := fCache.Get(context.Background(), keyConfig.Apply(request))
+			if tt.persisted && (item == nil || string(item.Body) != "firstsecond") {
+				t.Errorf("streamed body should be persisted")
+			}
+			if !tt.persisted && item != nil {
+				t.Errorf("streamed body should not be persisted")
+			}
+		})
+	}
+}
+
+func Test_cacheBehavior_ServeHTTP_ObjectSize(t *testing.T) {
+	initMetricsAndLogs()
+	keyConfig := &cache.KeyConfig{AllQuery: true}
+	tests := []struct {
+		name          string
+		body          string
+		contentLength bool
+		persisted     bool
+	}{
+		{name: "allowed by content-length", body: "0123456789", contentLength: true, persisted: true},
+		{name: "allowed by counted bytes", body: "0123456789", contentLength: false, persisted: true},
+		{name: "too big by content-length", body: "0123456789abcdef", contentLength: true, persisted: false},
+		{name: "too big by counted bytes", body: "0123456789abcdef", contentLength: false, persisted: false},
+		{name: "too small by content-length", body: "012", contentLength: true, persisted: false},
+		{name: "too small by counted bytes", body: "012", contentLength: false, persisted: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fCache := newInMemoryCache()
+			fUpstream := newFakeUpstream().
+				WithOrdered(func(request *http.Request) (*http.Response, error) {
+					response := createResponse(200, http.Header{"Cache-Control": {"public, s-maxage=60"}}, []byte(tt.body))
+					response.ContentLength = -1
+					if tt.contentLength {
+						response.ContentLength = int64(len(tt.body))
+					}
+					return response, nil
+				}).
+				WithAny(func(request *http.Request) (*http.Response, error) {
+					t.Error("unexpected call upstream")
+					return nil, fmt.Errorf("unexpected call upstream")
+				})
+			cachebehavior := NewCacheBehavior(
+				user.Always(),
+				user.Always(),
+				keyConfig,
+				fUpstream,
+				fCache,
+				&orderedCacheControlFallback{},
+				&Config{MaxObjectSize: 12, MinObjectSize: 5},
+			)
+			request := createRequest(http.MethodGet, "http://127.0.0.1/object", nil, nil, nil)
+			recorder := httptest.NewRecorder()
+			cachebehavior.ServeHTTP(recorder, request)
+			if recorder.Body.String() != tt.body {
+				t.Errorf("wrong body: expected '%s', got '%s'", tt.body, recorder.Body.String())
+			}
+			timeout := time.NewTimer(100 * time.Millisecond)
+			for tt.persisted && fCache.SavingCount() == 0 {
+				select {
+				case <-timeout.C:
+					t.Fatal("no expected cache savings")
+				case <-time.After(time.Millisecond * 10):
+				}
+			}
+			if item := fCache.Get(context.Background(), keyConfig.Apply(request)); (item != nil) != tt.persisted {
+				t.Errorf("persisted: expected %v, got %v", tt.persisted, item != nil)
+			}
+		})
+	}
+}
+
+func Test_cacheBehavior_ServeHTTP_Range(t *testing.T) {
+	initMetricsAndLogs()
+	keyConfig := &cache.KeyConfig{AllQuery: true}
+	fBody := []byte("this is body")
+	cachedRequest := createRequest(http.MethodGet, "http://127.0.0.1/cached", http.Header{"Range": {"bytes=0-3"}}, nil, nil)
+	fullRequest := createRequest(http.MethodGet, "http://127.0.0.1/full", http.Header{"Range": {"bytes=5-6"}}, nil, nil)
+	partialRequest := createRequest(http.MethodGet, "http://127.0.0.1/partial", http.Header{"Range": {"bytes=5-6"}}, nil, nil)
+	fCache := newInMemoryCache().
+		With(cachedRequest, keyConfig, &cache.Item{
+			SavedAt:     time.Now(),
+			CacheHeader: cache.CacheControl{Public: true, SMaxAge: time.Hour},
+			Headers:     http.Header{"Content-Length": {strconv.Itoa(len(fBody))}},
+			Body:        fBody,
+		})
+	fUpstream := newFakeUpstream().
+		WithOrdered(func(request *http.Request) (*http.Response, error) {
+			if request.Header.Get("Range") != "" {
+				t.Error("full object should be requested")
+			}
+			return createResponse(200, http.Header{"Cache-Control": {"public, s-maxage=60"}}, fBody), nil
+		}).
+		WithOrdered(func(request *http.Request) (*http.Response, error) {
+			return createResponse(
+				http.StatusPartialContent,
+				http.Header{"Cache-Control": {"public, s-maxage=60"}, "Content-Range": {"bytes 5-6/12"}},
+				fBody[5:7],
+			), nil
+		}).
+		WithAny(func(request *http.Request) (*http.Response, error) {
+			t.Error("unexpected call upstream")
+			return nil, fmt.Errorf("unexpected call upstream")
+		})
+	config := &Config{}
+	cachebehavior := NewCacheBehavior(
+		user.Always(),
+		user.Always(),
+		keyConfig,
+		fUpstream,
+		fCache,
+		&orderedCacheControlFallback{},
+		config,
+	)
+
+	for _, tt := range []struct {
+		request          *http.Request
+		fetchFullMaxSize int64
+		cacheStatus      string
+		body             string
+		contentRange     string
+	}{
+		{request: cachedRequest, cacheStatus: "HIT", body: "this", contentRange: "bytes 0-3/12"},
+		{request: fullRequest, fetchFullMaxSize: 1024, cacheStatus: "MISS", body: "is", contentRange: "bytes 5-6/12"},
+		{request: partialRequest, cacheStatus: "MISS", body: "is", contentRange: "bytes 5-6/12"},
+	} {
+		config.RangeRequests.FetchFullMaxSize = tt.fetchFullMaxSize
+		recorder := httptest.NewRecorder()
+		cachebehavior.ServeHTTP(recorder, tt.request)
+		if recorder.Code != http.StatusPartialContent {
+			t.Errorf("%s wrong status code: expected %d, got %d", tt.request.URL.Path, http.StatusPartialContent, recorder.Code)
+		}
+		if got := recorder.Header().Get("X-Cache-Status"); got != tt.cacheStatus {
+			t.Errorf("%s wrong cache status: expected %s, got %s", tt.request.URL.Path, tt.cacheStatus, got)
+		}
+		if got := recorder.Header().Get("Content-Range"); got != tt.contentRange {
+			t.Errorf("%s wrong content range: expected %s, got %s", tt.request.URL.Path, tt.contentRange, got)
+		}
+		if recorder.Body.String() != tt.body {
+			t.Errorf("%s wrong body: expected '%s', got '%s'", tt.request.URL.Path, tt.body, recorder.Body.String())
+		}
+	}
+	timeout := time.NewTimer(time.Second)
+	for fCache.SavingCount() != 2 {
+		select {
+		case <-timeout.C:
+			t.Fatal("no expected cache savings")
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+	if item := fCache.Get(context.Background(), keyConfig.Apply(fullRequest)); item == nil || string(item.Body) != string(fBody) {
+		t.Error("full object should be persisted")
+	}
+	if item := fCache.Get(context.Background(), keyConfig.Apply(partialRequest)); item != nil {
+		t.Error("partial content should not be persisted")
+	}
+}
+
+func Test_cacheBehavior_ServeHTTP_RangeFromStream(t *testing.T) {
+	initMetricsAndLogs()
+	keyConfig := &cache.KeyConfig{AllQuery: true}
+	fBody := []byte("this is body")
+	calls := 0
+	fUpstream := newFakeUpstream().
+		WithAny(func(request *http.Request) (*http.Response, error) {
+			calls++
+			if request.Header.Get("Range") != "" {
+				t.Error("full object should be requested")
+			}
+			return createResponse(200, http.Header{
+				"Cache-Control":  {"private"},
+				"Content-Length": {strconv.Itoa(len(fBody))},
+				"ETag":           {`"v1"`},
+			}, fBody), nil
+		})
+	config := &Config{RangeRequests: RangeRequestsConfig{FetchFullMaxSize: 1024}}
+	cachebehavior := NewCacheBehavior(
+		user.Always(),
+		user.Always(),
+		keyConfig,
+		fUpstream,
+		newInMemoryCache(),
+		&orderedCacheControlFallback{},
+		config,
+	)
+
+	for _, tt := range []struct {
+		rangeHeader  string
+		ifRange      string
+		status       int
+		body         string
+		contentRange string
+	}{
+		{rangeHeader: "bytes=5-6", status: http.StatusPartialContent, body: "is", contentRange: "bytes 5-6/12"},
+		{rangeHeader: "bytes=8-", status: http.StatusPartialContent, body: "body", contentRange: "bytes 8-11/12"},
+		{rangeHeader: "bytes=-4", status: http.StatusPartialContent, body: "body", contentRange: "bytes 8-11/12"},
+		{rangeHeader: "bytes=8-100", status: http.StatusPartialContent, body: "body", contentRange: "bytes 8-11/12"},
+		{rangeHeader: "bytes=20-", status: http.StatusRequestedRangeNotSatisfiable, body: "", contentRange: "bytes */12"},
+		{rangeHeader: "bytes=0-1,5-6", status: http.StatusOK, body: "this is body"},
+		{rangeHeader: "bytes=5-6", ifRange: `"v1"`, status: http.StatusPartialContent, body: "is", contentRange: "bytes 5-6/12"},
+		{rangeHeader: "bytes=5-6", ifRange: `"v0"`, status: http.StatusOK, body: "this is body"},
+	} {
+		calls = 0
+		header := http.Header{"Range": {tt.rangeHeader}}
+		if tt.ifRange != "" {
+			header.Set("If-Range", tt.ifRange)
+		}
+		recorder := httptest.NewRecorder()
+		cachebehavior.ServeHTTP(recorder, createRequest(http.MethodGet, "http://127.0.0.1/private", header, nil, nil))
+		name := tt.rangeHeader + " " + tt.ifRange
+		if calls != 1 {
+			t.Errorf("%s: upstream calls: expected 1, got %d", name, calls)
+		}
+		if recorder.Code != tt.status {
+			t.Errorf("%s wrong status code: expected %d, got %d", name, tt.status, recorder.Code)
+		}
+		if got := recorder.Header().Get("Content-Range"); got != tt.contentRange {
+			t.Errorf("%s wrong content range: expected %s, got %s", name, tt.contentRange, got)
+		}
+		if recorder.Body.String() != tt.body {
+			t.Errorf("%s wrong body: expected '%s', got '%s'", name, tt.body, recorder.Body.String())
+		}
+	}
+}
+
+func Test_cacheBehavior_ServeHTTP_RangeOfBigObject(t *testing.T) {
+	initMetricsAndLogs()
+	keyConfig := &cache.KeyConfig{AllQuery: true}
+	fBody := []byte("this is body")
+	for _, tt := range []struct {
+		name          string
+		knownLength   bool
+		rangeHeader   string
+		upstreamCalls int
+		body          string
+		contentRange  string
+	}{
+		{name: "known length", knownLength: true, rangeHeader: "bytes=2-3", upstreamCalls: 2, body: "is", contentRange: "bytes 2-3/12"},
+		{name: "chunked range in read part", rangeHeader: "bytes=2-3", upstreamCalls: 1, body: "is", contentRange: "bytes 2-3/*"},
+		{name: "chunked range after read part", rangeHeader: "bytes=8-11", upstreamCalls: 2, body: "body", contentRange: "bytes 8-11/12"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			fUpstream := newFakeUpstream().
+				WithAny(func(request *http.Request) (*http.Response, error) {
+					calls++
+					if rangeHeader := request.Header.Get("Range"); rangeHeader != "" {
+						byteRange, _, _ := parseSingleRange(rangeHeader, int64(len(fBody)))
+						return createResponse(http.StatusPartialContent, http.Header{
+							"Content-Range": {fmt.Sprintf("bytes %d-%d/%d", byteRange.start, byteRange.end, len(fBody))},
+						}, fBody[byteRange.start:byteRange.end+1]), nil
+					}
+					header := http.Header{"Cache-Control": {"public, s-maxage=60"}}
+					if tt.knownLength {
+						header.Set("Content-Length", strconv.Itoa(len(fBody)))
+					}
+					return createResponse(200, header, fBody), nil
+				})
+			fCache := newInMemoryCache()
+			cachebehavior := NewCacheBehavior(
+				user.Always(),
+				user.Always(),
+				keyConfig,
+				fUpstream,
+				fCache,
+				&orderedCacheControlFallback{},
+				&Config{RangeRequests: RangeRequestsConfig{FetchFullMaxSize: 4}},
+			)
+			recorder := httptest.NewRecorder()
+			cachebehavior.ServeHTTP(recorder, createRequest(http.MethodGet, "http://127.0.0.1/big", http.Header{"Range": {tt.rangeHeader}}, nil, nil))
+			if calls != tt.upstreamCalls {
+				t.Errorf("upstream calls: expected %d, got %d", tt.upstreamCalls, calls)
+			}
+			if recorder.Code != http.StatusPartialContent {
+				t.Errorf("wrong status code: expected %d, got %d", http.StatusPartialContent, recorder.Code)
+			}
+			if got := recorder.Header().Get("Content-Range"); got != tt.contentRange {
+				t.Errorf("wrong content range: expected %s, got %s", tt.contentRange, got)
+			}
+			if recorder.Body.String() != tt.body {
+				t.Errorf("wrong body: expected '%s', got '%s'", tt.body, recorder.Body.String())
+			}
+			if fCache.SavingCount() != 0 {
+				t.Error("object bigger than fetch_full_max_size should not be persisted")
+			}
+		})
+	}
+}
+
+func Test_cacheBehavior_ServeHTTP_Head(t *testing.T) {
+	initMetricsAndLogs()
+	keyConfig := &cache.KeyConfig{AllQuery: true}
+	fBody := []byte("this is body")
+	cachedRequest := createRequest(http.MethodHead, "http://127.0.0.1/cached", nil, nil, nil)
+	fillRequest := createRequest(http.MethodHead, "http://127.0.0.1/fill", nil, nil, nil)
+	proxyRequest := createRequest(http.MethodHead, "http://127.0.0.1/proxy", nil, nil, nil)
+	fCache := newInMemoryCache().
+		With(cachedRequest, keyConfig, &cache.Item{
+			SavedAt:     time.Now(),
+			CacheHeader: cache.CacheControl{Public: true, SMaxAge: time.Hour},
+			Body:        fBody,
+		})
+	fUpstream := newFakeUpstream().
+		WithOrdered(func(request *http.Request) (*http.Response, error) {
+			if request.Method != http.MethodGet {
+				t.Errorf("fill request should be GET, got %s", request.Method)
+			}
+			return createResponse(200, http.Header{
+				"Cache-Control":  {"public, s-maxage=60"},
+				"Content-Length": {strconv.Itoa(len(fBody))},
+			}, fBody), nil
+		}).
+		WithOrdered(func(request *http.Request) (*http.Response, error) {
+			if request.Method != http.MethodHead {
+				t.Errorf("proxy request should be HEAD, got %s", request.Method)
+			}
+			return createResponse(200, http.Header{
+				"Cache-Control":  {"public, s-maxage=60"},
+				"Content-Length": {strconv.Itoa(len(fBody))},
+			}, nil), nil
+		}).
+		WithAny(func(request *http.Request) (*http.Response, error) {
+			t.Error("unexpected call upstream")
+			return nil, fmt.Errorf("unexpected call upstream")
+		})
+	config := &Config{}
+	cachebehavior := NewCacheBehavior(
+		user.Always(),
+		user.Always(),
+		keyConfig,
+		fUpstream,
+		fCache,
+		&orderedCacheControlFallback{},
+		config,
+	)
+
+	for _, tt := range []struct {
+		request     *http.Request
+		fillWithGet bool
+		cacheStatus string
+	}{
+		{request: cachedRequest, cacheStatus: "HIT"},
+		{request: fillRequest, fillWithGet: true, cacheStatus: "MISS"},
+		{request: proxyRequest, cacheStatus: "MISS"},
+	} {
+		config.HeadRequests.FillWithGet = tt.fillWithGet
+		recorder := httptest.NewRecorder()
+		cachebehavior.ServeHTTP(recorder, tt.request)
+		if recorder.Code != 200 {
+			t.Errorf("%s wrong status code: expected %d, got %d", tt.request.URL.Path, 200, recorder.Code)
+		}
+		if got := recorder.Header().Get("X-Cache-Status"); got != tt.cacheStatus {
+			t.Errorf("%s wrong cache status: expected %s, got %s", tt.request.URL.Path, tt.cacheStatus, got)
+		}
+		if got := recorder.Header().Get("Content-Length"); got != strconv.Itoa(len(fBody)) {
+			t.Errorf("%s wrong content length: expected %d, got %s", tt.request.URL.Path, len(fBody), got)
+		}
+		if recorder.Body.Len() != 0 {
+			t.Errorf("%s body should be empty, got '%s'", tt.request.URL.Path, recorder.Body.String())
+		}
+	}
+	timeout := time.NewTimer(time.Second)
+	for fCache.SavingCount() != 2 {
+		select {
+		case <-timeout.C:
+			t.Fatal("no expected cache savings")
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+	if item := fCache.Get(context.Background(), keyConfig.Apply(fillRequest)); item == nil || string(item.Body) != string(fBody) {
+		t.Error("object should be persisted with body")
+	}
+	if item := fCache.Get(context.Background(), keyConfig.Apply(proxyRequest)); item != nil {
+		t.Error("HEAD response should not be persisted")
+	}
+}
+
+func Test_cacheBehavior_ServeHTTP_Coalescing(t *testing.T) {
+	initMetricsAndLogs()
+	keyConfig := &cache.KeyConfig{AllQuery: true}
+	fBody := []byte("this is body")
+	testingRequest := createRequest(http.MethodGet, "http://127.0.0.1/popular", nil, nil, nil)
+	called := make(chan struct{})
+	unblock := make(chan struct{})
+	upstreamCalls := 0
+	fUpstream := newFakeUpstream().
+		WithAny(func(request *http.Request) (*http.Response, error) {
+			upstreamCalls++
+			close(called)
+			<-unblock
+			return createResponse(200, http.Header{"Cache-Control": {"public, s-maxage=60"}}, fBody), nil
+		})
+	cachebehavior := NewCacheBehavior(
+		user.Always(),
+		user.Always(),
+		keyConfig,
+		fUpstream,
+		newInMemoryCache(),
+		&orderedCacheControlFallback{},
+		&Config{Coalescing: CoalescingConfig{Enabled: true, MaxWait: 5 * time.Second}},
+	)
+
+	const followers = 5
+	recorders := make([]*httptest.ResponseRecorder, followers+1)
+	wg := sync.WaitGroup{}
+	serve := func(i int) {
+		defer wg.Done()
+		recorders[i] = httptest.NewRecorder()
+		cachebehavior.ServeHTTP(recorders[i], testingRequest)
+	}
+	wg.Add(1)
+	go serve(0)
+	<-called
+	for i := 1; i <= followers; i++ {
+		wg.Add(1)
+		go serve(i)
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(unblock)
+	wg.Wait()
+
+	if upstreamCalls != 1 {
+		t.Errorf("upstream should be called once, called %d", upstreamCalls)
+	}
+	for i, recorder := range recorders {
+		expectedStatus := metrics.BoolToString(i == 0, "MISS", "HIT-COLLAPSED")
+		if got := recorder.Header().Get("X-Cache-Status"); got != expectedStatus {
+			t.Errorf("r%d wrong cache status: expected %s, got %s", i, expectedStatus, got)
+		}
+		if recorder.Body.String() != string(fBody) {
+			t.Errorf("r%d wrong body: expected '%s', got '%s'", i, string(fBody), recorder.Body.String())
+		}
+	}
+}
+
+func Test_cacheBehavior_ServeHTTP_RevalidationLock(t *testing.T) {
+	initMetricsAndLogs()
+	keyConfig := &cache.KeyConfig{AllQuery: true}
+	fBody := []byte("this is body")
+	staleRequest := createRequest(http.MethodGet, "http://127.0.0.1/stale", nil, nil, nil)
+	expiredRequest := createRequest(http.MethodGet, "http://127.0.0.1/expired", nil, nil, nil)
+	cacheControl := cache.CacheControl{
+		Public:               true,
+		SMaxAge:              time.Minute,
+		StaleWhileRevalidate: time.Hour,
+		StaleIfError:         3 * time.Hour,
+	}
+	fCache := newInMemoryCache().
+		With(staleRequest, keyConfig, &cache.Item{
+			SavedAt:     time.Now().Add(-10 * time.Minute),
+			CacheHeader: cacheControl,
+			Body:        fBody,
+		}).
+		With(expiredRequest, keyConfig, &cache.Item{
+			SavedAt:     time.Now().Add(-2 * time.Hour),
+			CacheHeader: cacheControl,
+			Body:        fBody,
+		})
+	for _, request := range []*http.Request{staleRequest, expiredRequest} {
+		// held by other replica
+		if _, acquired, _ := fCache.TryLock(context.Background(), keyConfig.Apply(request), time.Minute); !acquired {
+			t.Fatal("cant take lock")
+		}
+	}
+	fUpstream := newFakeUpstream().
+		WithAny(func(request *http.Request) (*http.Response, error) {
+			t.Error("unexpected call upstream")
+			return nil, fmt.Errorf("unexpected call upstream")
+		})
+	cachebehavior := NewCacheBehavior(
+		user.Always(),
+		user.Always(),
+		keyConfig,
+		fUpstream,
+		fCache,
+		&orderedCacheControlFallback{},
+		&Config{RevalidationLock: RevalidationLockConfig{Enabled: true, TTL: time.Minute, BlockingFill: true}},
+	)
+	for _, request := range []*http.Request{staleRequest, expiredRequest} {
+		recorder := httptest.NewRecorder()
+		cachebehavior.ServeHTTP(recorder, request)
+		if got := recorder.Header().Get("X-Cache-Status"); got != "HIT-STALE" {
+			t.Errorf("%s wrong cache status: expected %s, got %s", request.URL.Path, "HIT-STALE", got)
+		}
+		if recorder.Body.String() != string(fBody) {
+			t.Errorf("%s wrong body: expected '%s', got '%s'", request.URL.Path, string(fBody), recorder.Body.String())
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if fCache.SavingCount() != 2 || fCache.RefreshCount() != 0 {
+		t.Errorf("cache should not be changed")
+	}
+}
+
+func Test_cacheBehavior_ServeHTTP_RevalidationLockOfCanceledRequest(t *testing.T) {
+	initMetricsAndLogs()
+	keyConfig := &cache.KeyConfig{AllQuery: true}
+	fBody := []byte("this is body")
+	ctx, cancel := context.WithCancel(context.Background())
+	// background revalidation runs after client is gone
+	cancel()
+	request := createRequest(http.MethodGet, "http://127.0.0.1/stale", nil, nil, nil).WithContext(ctx)
+	fCache := newInMemoryCache().
+		With(request, keyConfig, &cache.Item{
+			SavedAt:     time.Now().Add(-10 * time.Minute),
+			CacheHeader: cache.CacheControl{Public: true, SMaxAge: time.Minute, StaleWhileRevalidate: time.Hour},
+			Body:        fBody,
+		})
+	fUpstream := newFakeUpstream().
+		WithAny(func(request *http.Request) (*http.Response, error) {
+			return createResponse(200, http.Header{"Cache-Control": {"public, s-maxage=60"}}, []byte("new body")), nil
+		})
+	cachebehavior := NewCacheBehavior(
+		user.Always(),
+		user.Always(),
+		keyConfig,
+		fUpstream,
+		fCache,
+		&orderedCacheControlFallback{},
+		&Config{RevalidationLock: RevalidationLockConfig{Enabled: true, TTL: time.Minute, OnLockError: OnLockErrorSkip}},
+	)
+	recorder := httptest.NewRecorder()
+	cachebehavior.ServeHTTP(recorder, request)
+	if got := recorder.Header().Get("X-Cache-Status"); got != "HIT-STALE" {
+		t.Errorf("wrong cache status: expected %s, got %s", "HIT-STALE", got)
+	}
+	timeout := time.NewTimer(time.Second)
+	for fCache.SavingCount() != 2 {
+		select {
+		case <-timeout.C:
+			t.Fatal("stale cache is not revalidated")
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+	if item := fCache.Get(context.Background(), keyConfig.Apply(request)); string(item.Body) != "new body" {
+		t.Errorf("wrong body: expected 'new body', got '%s'", string(item.Body))
+	}
+}
+
+func Test_cacheBehavior_ServeHTTP_RevalidationRetry(t *testing.T) {
+	initMetricsAndLogs()
+	keyConfig := &cache.KeyConfig{AllQuery: true}
+	requests := atomic.Int32{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Cache-Control", "public, s-maxage=60")
+		_, _ = w.Write([]byte("new body"))
+	}))
+	defer server.Close()
+	upstreamConfig := &upstream.Config{
+		Host:   strings.TrimPrefix(server.URL, "http://"),
+		Scheme: "http",
+		TransportPoolConfig: upstream.TransportPoolConfig{
+			Size:                1,
+			MaxIdleConnsPerHost: 1,
+			IdleConnTimeout:     time.Second,
+			ConnTimeout:         time.Second,
+			KeepAliveTimeout:    time.Second,
+			MaxLifeTime:         time.Minute,
+		},
+		Retry: upstream.RetryConfig{Attempts: 1, BaseBackoff: 20 * time.Millisecond},
+	}
+	if err := upstreamConfig.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	// retry backoff of background revalidation happens after client is gone
+	cancel()
+	request := createRequest(http.MethodGet, "http://127.0.0.1/stale", nil, nil, nil).WithContext(ctx)
+	fCache := newInMemoryCache().
+		With(request, keyConfig, &cache.Item{
+			SavedAt:     time.Now().Add(-10 * time.Minute),
+			CacheHeader: cache.CacheControl{Public: true, SMaxAge: time.Minute, StaleWhileRevalidate: time.Hour},
+			Body:        []byte("old body"),
+		})
+	cachebehavior := NewCacheBehavior(
+		user.Always(),
+		user.Always(),
+		keyConfig,
+		upstreamConfig.CreateUpstream("test"),
+		fCache,
+		&orderedCacheControlFallback{},
+		&Config{},
+	)
+	recorder := httptest.NewRecorder()
+	cachebehavior.ServeHTTP(recorder, request)
+	if got := recorder.Header().Get("X-Cache-Status"); got != "HIT-STALE" {
+		t.Errorf("wrong cache status: expected %s, got %s", "HIT-STALE", got)
+	}
+	timeout := time.NewTimer(time.Second)
+	for fCache.SavingCount() != 2 {
+		select {
+		case <-timeout.C:
+			t.Fatalf("stale cache is not revalidated after retry, upstream got %d requests", requests.Load())
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+	if item := fCache.Get(context.Background(), keyConfig.Apply(request)); string(item.Body) != "new body" {
+		t.Errorf("wrong body: expected 'new body', got '%s'", string(item.Body))
+	}
+}
+
+// lockCheckingCache remembers if revalidation lock of key is held while item is saved
+type lockCheckingCache struct {
+	*inMemoryCache
+	m           sync.Mutex
+	lockedOnSet []bool
+}
+
+func (c *lockCheckingCache) Set(ctx context.Context, key string, value *cache.Item, mode cache.WriteMode) {
+	c.m.Lock()
+	c.lockedOnSet = append(c.lockedOnSet, c.inMemoryCache.Locked(key))
+	c.m.Unlock()
+	c.inMemoryCache.Set(ctx, key, value, mode)
+}
+
+func Test_cacheBehavior_ServeHTTP_BlockingFillLockIsHeldTillSaving(t *testing.T) {
+	initMetricsAndLogs()
+	keyConfig := &cache.KeyConfig{AllQuery: true}
+	request := createRequest(http.MethodGet, "http://127.0.0.1/miss", nil, nil, nil)
+	fCache := &lockCheckingCache{inMemoryCache: newInMemoryCache()}
+	fUpstream := newFakeUpstream().
+		WithAny(func(request *http.Request) (*http.Response, error) {
+			return createResponse(200, http.Header{"Cache-Control": {"public, s-maxage=60"}}, []byte("body")), nil
+		})
+	cachebehavior := NewCacheBehavior(
+		user.Always(),
+		user.Always(),
+		keyConfig,
+		fUpstream,
+		fCache,
+		&orderedCacheControlFallback{},
+		&Config{RevalidationLock: RevalidationLockConfig{Enabled: true, TTL: time.Minute, BlockingFill: true}},
+	)
+	recorder := httptest.NewRecorder()
+	cachebehavior.ServeHTTP(recorder, request)
+	if got := recorder.Header().Get("X-Cache-Status"); got != "MISS" {
+		t.Errorf("wrong cache status: expected %s, got %s", "MISS", got)
+	}
+	key := keyConfig.Apply(request)
+	timeout := time.NewTimer(time.Second)
+	for fCache.SavingCount() != 1 || fCache.Locked(key) {
+		select {
+		case <-timeout.C:
+			t.Fatal("cache is not saved or lock is not released")
+		case <-time.After(time.Millisecond * 10):
+		}
+	}
+	fCache.m.Lock()
+	defer fCache.m.Unlock()
+	if len(fCache.lockedOnSet) != 1 || !fCache.lockedOnSet[0] {
+		t.Errorf("lock should be held while cache is saved, got %v", fCache.lockedOnSet)
+	}
+}
+
 func requestIsEqualWithoutBody(expected *http.Request, got *http.Request) error {
 	if expected.Method != got.Method {
 		return fmt.Errorf("method invalid: expected %s, got %s", expected.Method, got.Method)
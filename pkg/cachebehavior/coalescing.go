@@ -0,0 +1,96 @@
+package cachebehavior
+
+import (
+	"context"
+	"github.com/paragor/simple_cdn/pkg/cache"
+	"sync"
+	"time"
+)
+
+// inflightRequests collapses concurrent cache misses of the same cache key,
+// only the leader goes to upstream, followers wait for its cache item
+type inflightRequests struct {
+	m        sync.Mutex
+	requests map[string]*inflightRequest
+}
+
+func newInflightRequests() *inflightRequests {
+	return &inflightRequests{requests: make(map[string]*inflightRequest)}
+}
+
+// inflightRequest is cache fill of the leader, it could be without group if collapsing is disabled
+type inflightRequest struct {
+	group     *inflightRequests
+	key       string
+	once      sync.Once
+	done      chan struct{}
+	item      *cache.Item
+	followers int
+	// variantKey and vary are set if item is only for requests with the same values of vary headers
+	variantKey string
+	vary       []string
+}
+
+func newInflightRequest(group *inflightRequests, key string) *inflightRequest {
+	return &inflightRequest{group: group, key: key, done: make(chan struct{})}
+}
+
+// acquire returns inflight request of key and true if caller is the leader
+func (g *inflightRequests) acquire(key string) (*inflightRequest, bool) {
+	g.m.Lock()
+	defer g.m.Unlock()
+	if request, ok := g.requests[key]; ok {
+		request.followers++
+		return request, false
+	}
+	request := newInflightRequest(g, key)
+	g.requests[key] = request
+	return request, true
+}
+
+// release wakes up followers, item is nil if leader response is not cachable.
+// Only first call matters. Returns true if there are followers which use item.
+func (r *inflightRequest) release(item *cache.Item) bool {
+	return r.releaseVariant(item, "", nil)
+}
+
+// releaseVariant is release of item varied by vary request headers and stored by variantKey
+func (r *inflightRequest) releaseVariant(item *cache.Item, variantKey string, vary []string) bool {
+	hasFollowers := false
+	r.once.Do(func() {
+		r.item = item
+		r.variantKey = variantKey
+		r.vary = vary
+		if r.group != nil {
+			r.group.m.Lock()
+			if r.group.requests[r.key] == r {
+				delete(r.group.requests, r.key)
+			}
+			hasFollowers = r.followers > 0
+			r.group.m.Unlock()
+		}
+		close(r.done)
+	})
+	return hasFollowers
+}
+
+// wait returns item of the leader and result for metrics,
+// variantKey computes key of follower variant if leader item is varied
+func (r *inflightRequest) wait(ctx context.Context, maxWait time.Duration, variantKey func(vary []string) string) (*cache.Item, string) {
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+	select {
+	case <-r.done:
+		if r.item == nil {
+			return nil, "uncachable"
+		}
+		if len(r.vary) > 0 && variantKey(r.vary) != r.variantKey {
+			return nil, "other_variant"
+		}
+		return r.item, "hit"
+	case <-timer.C:
+		return nil, "timeout"
+	case <-ctx.Done():
+		return nil, "canceled"
+	}
+}
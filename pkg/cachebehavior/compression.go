@@ -0,0 +1,136 @@
+package cachebehavior
+
+import (
+	"context"
+	"github.com/paragor/simple_cdn/pkg/cache"
+	"github.com/paragor/simple_cdn/pkg/compression"
+	"github.com/paragor/simple_cdn/pkg/metrics"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// serve writes item as response, body is encoded by content coding negotiated with client
+func (b *cacheBehavior) serve(w http.ResponseWriter, r *http.Request, item *cache.Item) error {
+	_, _, err := b.serveEncoded(w, r, "", item)
+	return err
+}
+
+// serveStored is serve of item stored by key, body encoded on the fly is added to stored item,
+// so item is encoded only once
+func (b *cacheBehavior) serveStored(w http.ResponseWriter, r *http.Request, key string, item *cache.Item) error {
+	encoding, encoded, err := b.serveEncoded(w, r, key, item)
+	if encoded == nil {
+		return err
+	}
+	ctx := context.WithoutCancel(r.Context())
+	b.pool.submit(&backgroundJob{kind: backgroundJobCacheSaving, key: "encoded|" + encoding + "|" + key, run: func() {
+		b.cache.SetEncoded(ctx, key, item.SavedAt, encoding, encoded)
+	}})
+	return err
+}
+
+// serveEncoded writes item as response, returns body if it is encoded on the fly.
+// Encoded body of item stored by key is fetched from cache, empty key means that item is not stored
+func (b *cacheBehavior) serveEncoded(w http.ResponseWriter, r *http.Request, key string, item *cache.Item) (string, []byte, error) {
+	headers := http.Header(item.Headers)
+	if !b.config.Compression.compressible(headers, int64(len(item.Body))) {
+		return "", nil, item.Serve(w, r)
+	}
+	addVaryAcceptEncoding(headers, w.Header())
+	encoding := b.config.Compression.negotiate(r)
+	if encoding == "" {
+		return "", nil, item.Serve(w, r)
+	}
+	body, ok := item.Encoded[encoding]
+	if !ok && key != "" {
+		body = b.cache.GetEncoded(r.Context(), key, item.SavedAt, encoding)
+	}
+	if body != nil {
+		metrics.CompressedResponses.WithLabelValues(encoding, "stored").Inc()
+		return "", nil, item.ServeEncoded(w, r, encoding, body)
+	}
+	encoded, err := compression.Encode(encoding, item.Body)
+	if err != nil {
+		return "", nil, item.Serve(w, r)
+	}
+	metrics.CompressedResponses.WithLabelValues(encoding, "on_the_fly").Inc()
+	return encoding, encoded, item.ServeEncoded(w, r, encoding, encoded)
+}
+
+// compressResponse prepares headers of upstream response for content coding negotiated with client,
+// it should be called before WriteHeader, returned writer should be closed after body is written
+func (b *cacheBehavior) compressResponse(w http.ResponseWriter, r *http.Request, response *http.Response) io.WriteCloser {
+	if !b.config.Compression.compressible(response.Header, response.ContentLength) {
+		return nopWriteCloser{w}
+	}
+	addVaryAcceptEncoding(response.Header, w.Header())
+	encoding := b.config.Compression.negotiate(r)
+	if encoding == "" {
+		return nopWriteCloser{w}
+	}
+	writer, err := compression.NewStreamingWriter(encoding, w)
+	if err != nil {
+		return nopWriteCloser{w}
+	}
+	metrics.CompressedResponses.WithLabelValues(encoding, "on_the_fly").Inc()
+	compression.SetHeaders(w.Header(), encoding)
+	return writer
+}
+
+// withEncoded returns copy of item with body encoded by configured content codings to store them in cache
+func (b *cacheBehavior) withEncoded(item *cache.Item) *cache.Item {
+	config := &b.config.Compression
+	if !config.StoreEncoded || !config.compressible(item.Headers, int64(len(item.Body))) {
+		return item
+	}
+	encoded := make(map[string][]byte, len(config.encodings()))
+	for _, encoding := range config.encodings() {
+		if body, err := compression.Encode(encoding, item.Body); err == nil {
+			encoded[encoding] = body
+		}
+	}
+	stored := *item
+	stored.Encoded = encoded
+	return &stored
+}
+
+func addVaryAcceptEncoding(response http.Header, to http.Header) {
+	if !slices.Contains(cache.ParseVary(response), "accept-encoding") {
+		to.Add("Vary", "Accept-Encoding")
+	}
+}
+
+// compressible returns true if response could be encoded for client
+func (c *CompressionConfig) compressible(header http.Header, size int64) bool {
+	if !c.Enabled || header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" {
+		return false
+	}
+	if size >= 0 && size < c.MinSize {
+		return false
+	}
+	if strings.Contains(strings.ToLower(header.Get("Cache-Control")), "no-transform") {
+		return false
+	}
+	contentType := strings.ToLower(header.Get("Content-Type"))
+	return slices.ContainsFunc(c.contentTypes(), func(prefix string) bool {
+		return strings.HasPrefix(contentType, prefix)
+	})
+}
+
+// negotiate returns content coding of response for request, empty string means identity
+func (c *CompressionConfig) negotiate(r *http.Request) string {
+	if (r.Method != http.MethodGet && r.Method != http.MethodHead) || r.Header.Get("Range") != "" {
+		return ""
+	}
+	return compression.Negotiate(r.Header.Get("Accept-Encoding"), c.encodings())
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,324 @@
+package cachebehavior
+
+import (
+	"fmt"
+	"github.com/paragor/simple_cdn/pkg/cache"
+	"github.com/paragor/simple_cdn/pkg/compression"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Config struct {
+	RangeRequests    RangeRequestsConfig    `yaml:"range_requests"`
+	HeadRequests     HeadRequestsConfig     `yaml:"head_requests"`
+	Coalescing       CoalescingConfig       `yaml:"coalescing"`
+	RevalidationLock RevalidationLockConfig `yaml:"revalidation_lock"`
+	Background       BackgroundConfig       `yaml:"background"`
+	EarlyRefresh     EarlyRefreshConfig     `yaml:"early_refresh"`
+	StaleIfSlow      StaleIfSlowConfig      `yaml:"stale_if_slow"`
+	Vary             VaryConfig             `yaml:"vary"`
+	Compression      CompressionConfig      `yaml:"compression"`
+	// MaxObjectSize - bigger responses are streamed to client without cache save, 0 means unlimited
+	MaxObjectSize int64 `yaml:"max_object_size"`
+	// MinObjectSize - smaller responses are not saved
+	MinObjectSize int64 `yaml:"min_object_size"`
+
+	backgroundPoolOnce sync.Once
+	backgroundPool     *backgroundPool
+}
+
+func (c *Config) Validate() error {
+	if c.MaxObjectSize < 0 {
+		return fmt.Errorf("max_object_size should be >= 0")
+	}
+	if c.MinObjectSize < 0 {
+		return fmt.Errorf("min_object_size should be >= 0")
+	}
+	if c.MaxObjectSize > 0 && c.MinObjectSize > c.MaxObjectSize {
+		return fmt.Errorf("min_object_size should be <= max_object_size")
+	}
+	if err := c.RangeRequests.Validate(); err != nil {
+		return fmt.Errorf("range_requests invalid: %w", err)
+	}
+	if err := c.Coalescing.Validate(); err != nil {
+		return fmt.Errorf("coalescing invalid: %w", err)
+	}
+	if err := c.RevalidationLock.Validate(); err != nil {
+		return fmt.Errorf("revalidation_lock invalid: %w", err)
+	}
+	if err := c.Background.Validate(); err != nil {
+		return fmt.Errorf("background invalid: %w", err)
+	}
+	if err := c.EarlyRefresh.Validate(); err != nil {
+		return fmt.Errorf("early_refresh invalid: %w", err)
+	}
+	if err := c.StaleIfSlow.Validate(); err != nil {
+		return fmt.Errorf("stale_if_slow invalid: %w", err)
+	}
+	if err := c.Vary.Validate(); err != nil {
+		return fmt.Errorf("vary invalid: %w", err)
+	}
+	if err := c.Compression.Validate(); err != nil {
+		return fmt.Errorf("compression invalid: %w", err)
+	}
+	return nil
+}
+
+// getBackgroundPool returns pool shared by all behaviors with the same config.
+// Jobs are deduplicated by cache key without namespace, so config must not be shared by sites with different namespaces
+func (c *Config) getBackgroundPool() *backgroundPool {
+	c.backgroundPoolOnce.Do(func() {
+		workers := c.Background.Workers
+		if workers <= 0 {
+			workers = defaultBackgroundWorkers
+		}
+		queueSize := c.Background.QueueSize
+		if queueSize <= 0 {
+			queueSize = defaultBackgroundQueueSize
+		}
+		c.backgroundPool = newBackgroundPool(workers, queueSize, c.Background.DropPolicy == DropPolicyOldest)
+	})
+	return c.backgroundPool
+}
+
+type RangeRequestsConfig struct {
+	// FetchFullMaxSize - on cache miss full object is fetched from upstream if it is not bigger, 0 means always proxy range
+	FetchFullMaxSize int64 `yaml:"fetch_full_max_size"`
+}
+
+func (c *RangeRequestsConfig) Validate() error {
+	if c.FetchFullMaxSize < 0 {
+		return fmt.Errorf("fetch_full_max_size should be >= 0")
+	}
+	return nil
+}
+
+type HeadRequestsConfig struct {
+	// FillWithGet - on cache miss GET request is sent to upstream to persist object
+	FillWithGet bool `yaml:"fill_with_get"`
+}
+
+type CoalescingConfig struct {
+	// Enabled - concurrent cache misses of the same key wait for the first upstream response
+	Enabled bool `yaml:"enabled"`
+	// MaxWait - how long followers wait, after that they go to upstream by themselves
+	MaxWait time.Duration `yaml:"max_wait"`
+}
+
+func (c *CoalescingConfig) Validate() error {
+	if c.Enabled && c.MaxWait <= 0 {
+		return fmt.Errorf("max_wait should be > 0")
+	}
+	return nil
+}
+
+const (
+	OnLockErrorProceed = "proceed"
+	OnLockErrorSkip    = "skip"
+)
+
+type RevalidationLockConfig struct {
+	// Enabled - lock shared between replicas is taken before background revalidation
+	Enabled bool          `yaml:"enabled"`
+	TTL     time.Duration `yaml:"ttl"`
+	// BlockingFill - lock is also taken before cache fill, others serve stale or wait for filled item
+	BlockingFill bool `yaml:"blocking_fill"`
+	// WaitTimeout - how long blocking fill waits for item filled by lock holder, after that it goes to upstream
+	WaitTimeout time.Duration `yaml:"wait_timeout"`
+	// ReleaseOnFailure - lock holder releases lock if it cant refresh item, otherwise lock is held until ttl
+	ReleaseOnFailure bool `yaml:"release_on_failure"`
+	// OnLockError - proceed (default) or skip revalidation if lock cant be taken due cache error
+	OnLockError string `yaml:"on_lock_error"`
+}
+
+func (c *RevalidationLockConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.TTL <= 0 {
+		return fmt.Errorf("ttl should be > 0")
+	}
+	if c.WaitTimeout < 0 {
+		return fmt.Errorf("wait_timeout should be >= 0")
+	}
+	if c.OnLockError != "" && c.OnLockError != OnLockErrorProceed && c.OnLockError != OnLockErrorSkip {
+		return fmt.Errorf("on_lock_error should have value %s or %s", OnLockErrorProceed, OnLockErrorSkip)
+	}
+	return nil
+}
+
+const (
+	DropPolicyNew    = "drop_new"
+	DropPolicyOldest = "drop_oldest"
+
+	defaultBackgroundWorkers        = 64
+	defaultBackgroundQueueSize      = 1024
+	defaultBackgroundRequestTimeout = time.Minute * 6
+)
+
+type BackgroundConfig struct {
+	// Workers - count of goroutines for cache fills and revalidations, default 64
+	Workers int `yaml:"workers"`
+	// QueueSize - max count of queued jobs, default 1024
+	QueueSize int `yaml:"queue_size"`
+	// DropPolicy - drop_new (default) or drop_oldest job if queue is full
+	DropPolicy string `yaml:"drop_policy"`
+	// RequestTimeout - max duration of upstream request of background job (with retries), default 6m
+	RequestTimeout time.Duration `yaml:"request_timeout"`
+}
+
+func (c *BackgroundConfig) Validate() error {
+	if c.Workers < 0 {
+		return fmt.Errorf("workers should be >= 0")
+	}
+	if c.QueueSize < 0 {
+		return fmt.Errorf("queue_size should be >= 0")
+	}
+	if c.DropPolicy != "" && c.DropPolicy != DropPolicyNew && c.DropPolicy != DropPolicyOldest {
+		return fmt.Errorf("drop_policy should have value %s or %s", DropPolicyNew, DropPolicyOldest)
+	}
+	if c.RequestTimeout < 0 {
+		return fmt.Errorf("request_timeout should be >= 0")
+	}
+	return nil
+}
+
+func (c *BackgroundConfig) requestTimeout() time.Duration {
+	if c.RequestTimeout <= 0 {
+		return defaultBackgroundRequestTimeout
+	}
+	return c.RequestTimeout
+}
+
+const defaultEarlyRefreshBeta = 1.0
+
+type EarlyRefreshConfig struct {
+	// Enabled - fresh items are probabilistically refreshed in background before s-maxage (XFetch)
+	Enabled bool `yaml:"enabled"`
+	// Beta - > 1 favors earlier refresh, < 1 favors later, default 1
+	Beta float64 `yaml:"beta"`
+}
+
+func (c *EarlyRefreshConfig) Validate() error {
+	if c.Beta < 0 {
+		return fmt.Errorf("beta should be >= 0")
+	}
+	return nil
+}
+
+func (c *EarlyRefreshConfig) beta() float64 {
+	if c.Beta == 0 {
+		return defaultEarlyRefreshBeta
+	}
+	return c.Beta
+}
+
+type StaleIfSlowConfig struct {
+	// Budget - if upstream have not answered within budget, item in stale-if-error window is served,
+	// upstream response refills cache in background. 0 means disabled
+	Budget time.Duration `yaml:"budget"`
+}
+
+func (c *StaleIfSlowConfig) Validate() error {
+	if c.Budget < 0 {
+		return fmt.Errorf("budget should be >= 0")
+	}
+	return nil
+}
+
+const (
+	VaryNoCache = "no_cache"
+	VaryIgnore  = "ignore"
+	VaryKey     = "key"
+)
+
+type VaryConfig struct {
+	// Star - no_cache (default) or ignore response with Vary: *
+	Star string `yaml:"star"`
+	// Cookie - key (default) variants by Cookie header or no_cache response with Vary: Cookie
+	Cookie string `yaml:"cookie"`
+	// IgnoreHeaders - headers of Vary which dont produce variants, Accept-Encoding is always ignored
+	IgnoreHeaders []string `yaml:"ignore_headers"`
+}
+
+func (c *VaryConfig) Validate() error {
+	if c.Star != "" && c.Star != VaryNoCache && c.Star != VaryIgnore {
+		return fmt.Errorf("star should have value %s or %s", VaryNoCache, VaryIgnore)
+	}
+	if c.Cookie != "" && c.Cookie != VaryKey && c.Cookie != VaryNoCache {
+		return fmt.Errorf("cookie should have value %s or %s", VaryKey, VaryNoCache)
+	}
+	return nil
+}
+
+// headers returns request headers which response varies on, false if response should not be cached
+func (c *VaryConfig) headers(response http.Header) ([]string, bool) {
+	vary := cache.ParseVary(response)
+	result := make([]string, 0, len(vary))
+	for _, header := range vary {
+		switch {
+		case header == "accept-encoding":
+		case slices.ContainsFunc(c.IgnoreHeaders, func(ignored string) bool { return strings.EqualFold(ignored, header) }):
+		case header == "*":
+			if c.Star != VaryIgnore {
+				return nil, false
+			}
+		case header == "cookie" && c.Cookie == VaryNoCache:
+			return nil, false
+		default:
+			result = append(result, header)
+		}
+	}
+	return result, true
+}
+
+var defaultCompressionContentTypes = []string{
+	"text/",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"image/svg+xml",
+}
+
+type CompressionConfig struct {
+	// Enabled - responses are encoded by content coding negotiated by Accept-Encoding
+	Enabled bool `yaml:"enabled"`
+	// Encodings - content codings in order of preference, default zstd, br, gzip
+	Encodings []string `yaml:"encodings"`
+	// ContentTypes - prefixes of compressible content types, default text/*, javascript, json, xml and svg
+	ContentTypes []string `yaml:"content_types"`
+	// MinSize - smaller bodies are not encoded
+	MinSize int64 `yaml:"min_size"`
+	// StoreEncoded - bodies encoded by all encodings are stored in cache along with body when item is saved,
+	// otherwise body encoded on the fly for cache hit is added to stored item. Stored zstd body is always served as is
+	StoreEncoded bool `yaml:"store_encoded"`
+}
+
+func (c *CompressionConfig) Validate() error {
+	for _, encoding := range c.Encodings {
+		if !compression.IsSupported(encoding) {
+			return fmt.Errorf("encoding %s is not supported, supported: %s", encoding, strings.Join(compression.Supported, ", "))
+		}
+	}
+	if c.MinSize < 0 {
+		return fmt.Errorf("min_size should be >= 0")
+	}
+	return nil
+}
+
+func (c *CompressionConfig) encodings() []string {
+	if len(c.Encodings) == 0 {
+		return compression.Supported
+	}
+	return c.Encodings
+}
+
+func (c *CompressionConfig) contentTypes() []string {
+	if len(c.ContentTypes) == 0 {
+		return defaultCompressionContentTypes
+	}
+	return c.ContentTypes
+}
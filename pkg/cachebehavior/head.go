@@ -0,0 +1,24 @@
+package cachebehavior
+
+import (
+	"net/http"
+)
+
+// getRequest returns GET request for object of HEAD request
+func getRequest(r *http.Request) *http.Request {
+	if r.Method != http.MethodHead {
+		return r
+	}
+	request := r.Clone(r.Context())
+	request.Method = http.MethodGet
+	return request
+}
+
+// headResponseWriter discards body, so HEAD request could be answered with GET response
+type headResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w *headResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
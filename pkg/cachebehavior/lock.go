@@ -0,0 +1,84 @@
+package cachebehavior
+
+import (
+	"context"
+	"github.com/paragor/simple_cdn/pkg/cache"
+	"github.com/paragor/simple_cdn/pkg/logger"
+	"github.com/paragor/simple_cdn/pkg/metrics"
+	"go.uber.org/zap"
+	"net/http"
+	"time"
+)
+
+const lockPollInterval = 100 * time.Millisecond
+
+// lockRevalidation takes lock of cache key shared between replicas.
+// Returns false if lock is held by someone else, release should be called with result of revalidation.
+func (b *cacheBehavior) lockRevalidation(ctx context.Context, cacheKey string) (release func(success bool), ok bool) {
+	config := b.config.RevalidationLock
+	if !config.Enabled {
+		return func(bool) {}, true
+	}
+	unlock, acquired, err := b.cache.TryLock(ctx, cacheKey, config.TTL)
+	if err != nil {
+		metrics.RevalidationLocks.WithLabelValues("error").Inc()
+		logger.FromCtx(ctx).
+			With(zap.String("component", "cacheBehavior")).
+			With(zap.Error(err)).
+			Error("cant take revalidation lock")
+		return func(bool) {}, config.OnLockError != OnLockErrorSkip
+	}
+	if !acquired {
+		metrics.RevalidationLocks.WithLabelValues("busy").Inc()
+		return nil, false
+	}
+	metrics.RevalidationLocks.WithLabelValues("acquired").Inc()
+	return func(success bool) {
+		if success || config.ReleaseOnFailure {
+			unlock()
+		}
+	}, true
+}
+
+// waitRemoteFill polls cache while lock holder fills it, returns nil after wait_timeout
+func (b *cacheBehavior) waitRemoteFill(r *http.Request, primaryKey string) *cache.Item {
+	ctx := r.Context()
+	deadline := time.Now().Add(b.config.RevalidationLock.WaitTimeout)
+	ticker := time.NewTicker(lockPollInterval)
+	defer ticker.Stop()
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		if _, item := b.load(ctx, r, primaryKey); item != nil && item.CanUseCache(time.Now()) {
+			return item
+		}
+	}
+	return nil
+}
+
+// fillLock is revalidation lock taken by handler for cache fill.
+// Lock is held till cache is saved, so it is handed over to background job which saves cache.
+type fillLock struct {
+	// release is nil if lock is not taken or it is handed over
+	release func(success bool)
+}
+
+// handOver returns release of lock for background job, handler does not release lock after that
+func (l *fillLock) handOver() func(success bool) {
+	release := l.release
+	l.release = nil
+	if release == nil {
+		return func(bool) {}
+	}
+	return release
+}
+
+// releaseByHandler releases lock if it is not handed over, handler have not filled cache in that case
+func (l *fillLock) releaseByHandler() {
+	if l.release != nil {
+		l.release(false)
+	}
+}
@@ -0,0 +1,251 @@
+package cachebehavior
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/paragor/simple_cdn/pkg/cache"
+	"github.com/paragor/simple_cdn/pkg/logger"
+	"github.com/paragor/simple_cdn/pkg/utils/pool"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func isRangeRequest(r *http.Request) bool {
+	return r.Header.Get("Range") != ""
+}
+
+// fullObjectRequest returns request without range headers
+func fullObjectRequest(r *http.Request) *http.Request {
+	if !isRangeRequest(r) {
+		return r
+	}
+	request := r.Clone(r.Context())
+	request.Header.Del("Range")
+	request.Header.Del("If-Range")
+	return request
+}
+
+// serveRangeFromFullResponse answers range request with 200 upstream response.
+// Upstream request could be sent without range (see RangeRequestsConfig), in this case
+// object is persisted only if it fits fetch_full_max_size, otherwise range is cut from read part of body
+// or requested from upstream.
+func (b *cacheBehavior) serveRangeFromFullResponse(
+	w http.ResponseWriter,
+	r *http.Request,
+	upstreamRequest *http.Request,
+	response *http.Response,
+	key storageKey,
+	canPersist bool,
+	cacheControl cache.CacheControl,
+	inflight *inflightRequest,
+	fill *fillLock,
+) {
+	log := logger.FromCtx(r.Context()).
+		With(zap.String("component", "cacheBehavior")).
+		With(zap.Bool("can_persist", canPersist))
+	fullFetched := !isRangeRequest(upstreamRequest)
+	// limit <= 0 means unlimited
+	limit := b.config.MaxObjectSize
+	if fetchFullMaxSize := b.config.RangeRequests.FetchFullMaxSize; fullFetched && fetchFullMaxSize > 0 && (limit <= 0 || fetchFullMaxSize < limit) {
+		limit = fetchFullMaxSize
+	}
+	if !canPersist && !fullFetched {
+		log.Debug("response to client without cache save")
+		proxyResponse(w, response, "MISS", log)
+		return
+	}
+	if fullFetched && limit > 0 && response.ContentLength > limit {
+		log.Debug("full object is too big, proxy range request")
+		b.proxyRangeRequest(w, r, response, log)
+		return
+	}
+	if !canPersist && limit <= 0 {
+		log.Debug("full object is not cachable, serve range from upstream response")
+		serveRangeFromStream(w, r, response, response.Body, log)
+		return
+	}
+
+	bodyBytes := pool.DefaultBufferPool.Get(max(pool.DefaultBufferPoolMinSize, int(response.ContentLength)))
+	bodyBytesClean := func() {
+		pool.DefaultBufferPool.Put(bodyBytes[:0])
+	}
+	bodyBuffer := bytes.NewBuffer(bodyBytes)
+	body := io.Reader(response.Body)
+	if limit > 0 {
+		body = io.LimitReader(response.Body, limit+1)
+	}
+	if _, err := bodyBuffer.ReadFrom(body); err != nil {
+		log.With(zap.Error(err)).Error("cant read all body from upstream")
+		bodyBytesClean()
+		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	tooBig := limit > 0 && int64(bodyBuffer.Len()) > limit
+	if tooBig && canPersist {
+		skipObject(log, objectTooBig)
+	}
+	if tooBig || !canPersist {
+		defer bodyBytesClean()
+		b.serveRangeFromBuffered(w, r, response, bodyBuffer, !tooBig, fullFetched, log)
+		return
+	}
+	item := cache.ItemFromResponse(response, cacheControl, bodyBuffer.Bytes())
+	if reason := b.config.objectSizeSkipReason(int64(bodyBuffer.Len())); reason != "" {
+		skipObject(log, reason)
+		defer bodyBytesClean()
+		w.Header().Set("X-Cache-Status", "MISS")
+		if err := b.serve(w, r, item); err != nil {
+			log.With(zap.Error(err)).Warn("cant write cache response")
+		}
+		return
+	}
+	if inflight.releaseVariant(item, key.variant, key.vary) {
+		// followers could write body after persisting, so buffer is not returned to pool
+		bodyBytesClean = func() {}
+	}
+	w.Header().Set("X-Cache-Status", "MISS")
+	if err := b.serve(w, r, item); err != nil {
+		log.With(zap.Error(err)).Warn("cant write cache response")
+	}
+	b.persist(r.Context(), key, item, bodyBytesClean, fill.handOver())
+}
+
+// serveRangeFromBuffered answers range request with response which body is read into buffer, the rest of body
+// is not read if buffer is not complete. Range is cut from body only if it starts within buffer, otherwise range
+// is requested from upstream, so object is not downloaded up to range start.
+func (b *cacheBehavior) serveRangeFromBuffered(
+	w http.ResponseWriter,
+	r *http.Request,
+	response *http.Response,
+	buffered *bytes.Buffer,
+	complete bool,
+	fullFetched bool,
+	log *zap.Logger,
+) {
+	if complete {
+		response.ContentLength = int64(buffered.Len())
+		serveRangeFromStream(w, r, response, buffered, log)
+		return
+	}
+	byteRange, ok, satisfiable := parseSingleRange(r.Header.Get("Range"), response.ContentLength)
+	// if upstream ignored range of request, range is not requested again
+	if !fullFetched || (ok && satisfiable && byteRange.start < int64(buffered.Len())) {
+		serveRangeFromStream(w, r, response, io.MultiReader(buffered, response.Body), log)
+		return
+	}
+	log.Debug("range is out of read part of body, proxy range request")
+	b.proxyRangeRequest(w, r, response, log)
+}
+
+// proxyRangeRequest closes full upstream response and proxies range request to upstream
+func (b *cacheBehavior) proxyRangeRequest(w http.ResponseWriter, r *http.Request, response *http.Response, log *zap.Logger) {
+	_ = response.Body.Close()
+	rangeResponse, err := b.upstream.Do(r)
+	if err != nil {
+		log.With(zap.Error(err)).Error("cant send request to upstream")
+		http.Error(w, "service unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer rangeResponse.Body.Close()
+	proxyResponse(w, rangeResponse, "MISS", log)
+}
+
+// serveRangeFromStream answers range request with range of 200 upstream response body without buffering.
+// Full response is sent if range could not be cut from stream (multiple ranges, unknown size, If-Range mismatch),
+// it is valid answer to range request.
+func serveRangeFromStream(w http.ResponseWriter, r *http.Request, response *http.Response, body io.Reader, log *zap.Logger) {
+	copyHeaders(response.Header, w.Header())
+	w.Header().Set("X-Cache-Status", "MISS")
+	byteRange, ok, satisfiable := parseSingleRange(r.Header.Get("Range"), response.ContentLength)
+	if !ok || !ifRangeMatches(r.Header.Get("If-Range"), response.Header) {
+		w.WriteHeader(response.StatusCode)
+		if err := ioCopy(w, body); err != nil {
+			log.With(zap.Error(err)).Warn("cant write response body")
+		}
+		return
+	}
+	w.Header().Del("Content-Length")
+	if !satisfiable {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", response.ContentLength))
+		w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	size := "*"
+	if response.ContentLength >= 0 {
+		size = strconv.FormatInt(response.ContentLength, 10)
+	}
+	length := byteRange.end - byteRange.start + 1
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", byteRange.start, byteRange.end, size))
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	w.WriteHeader(http.StatusPartialContent)
+	if _, err := io.CopyN(io.Discard, body, byteRange.start); err != nil {
+		log.With(zap.Error(err)).Warn("cant skip response body before range")
+		return
+	}
+	if err := ioCopy(w, io.LimitReader(body, length)); err != nil {
+		log.With(zap.Error(err)).Warn("cant write response body")
+	}
+}
+
+// byteRange is range of object, end is inclusive
+type byteRange struct {
+	start int64
+	end   int64
+}
+
+// parseSingleRange parses range header of object of size, size < 0 means unknown size.
+// ok is false if range could not be cut from stream, satisfiable is false if range is out of object.
+func parseSingleRange(header string, size int64) (result byteRange, ok bool, satisfiable bool) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return byteRange{}, false, false
+	}
+	startValue, endValue, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return byteRange{}, false, false
+	}
+	if startValue == "" {
+		// suffix range is the last bytes of object
+		suffix, err := strconv.ParseInt(endValue, 10, 64)
+		if err != nil || suffix < 0 || size < 0 {
+			return byteRange{}, false, false
+		}
+		if suffix == 0 || size == 0 {
+			return byteRange{}, true, false
+		}
+		return byteRange{start: max(size-suffix, 0), end: size - 1}, true, true
+	}
+	start, err := strconv.ParseInt(startValue, 10, 64)
+	if err != nil || start < 0 {
+		return byteRange{}, false, false
+	}
+	end := size - 1
+	if endValue != "" {
+		if end, err = strconv.ParseInt(endValue, 10, 64); err != nil || end < start {
+			return byteRange{}, false, false
+		}
+		if size >= 0 {
+			end = min(end, size-1)
+		}
+	} else if size < 0 {
+		return byteRange{}, false, false
+	}
+	if size >= 0 && start >= size {
+		return byteRange{}, true, false
+	}
+	return byteRange{start: start, end: end}, true, true
+}
+
+// ifRangeMatches returns true if range could be applied to response according to If-Range validator
+func ifRangeMatches(ifRange string, header http.Header) bool {
+	if ifRange == "" {
+		return true
+	}
+	if strings.HasPrefix(ifRange, `"`) {
+		return ifRange == header.Get("ETag")
+	}
+	return ifRange == header.Get("Last-Modified")
+}
@@ -0,0 +1,51 @@
+package cachebehavior
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+type upstreamResult struct {
+	response *http.Response
+	err      error
+}
+
+// doWithBudget sends request to upstream and waits for response not longer than budget.
+// If upstream is late answered is false and late is called with response as soon as upstream answers,
+// late is responsible for closing of response body.
+func (b *cacheBehavior) doWithBudget(
+	request *http.Request,
+	budget time.Duration,
+	late func(response *http.Response, err error),
+) (response *http.Response, answered bool, err error) {
+	m := sync.Mutex{}
+	abandoned := false
+	results := make(chan upstreamResult, 1)
+	go func() {
+		response, err := b.upstream.Do(request)
+		m.Lock()
+		defer m.Unlock()
+		if abandoned {
+			late(response, err)
+			return
+		}
+		results <- upstreamResult{response: response, err: err}
+	}()
+	timer := time.NewTimer(budget)
+	defer timer.Stop()
+	select {
+	case result := <-results:
+		return result.response, true, result.err
+	case <-timer.C:
+	}
+	m.Lock()
+	defer m.Unlock()
+	select {
+	case result := <-results:
+		return result.response, true, result.err
+	default:
+		abandoned = true
+		return nil, false, nil
+	}
+}
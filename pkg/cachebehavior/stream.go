@@ -0,0 +1,71 @@
+package cachebehavior
+
+import (
+	"bytes"
+	"github.com/paragor/simple_cdn/pkg/metrics"
+	"go.uber.org/zap"
+	"io"
+)
+
+const (
+	objectTooBig   = "too_big"
+	objectTooSmall = "too_small"
+)
+
+// objectSizeSkipReason returns reason why object is not persisted or empty string if size is allowed,
+// size < 0 means unknown size
+func (c *Config) objectSizeSkipReason(size int64) string {
+	if size < 0 {
+		return ""
+	}
+	if c.MaxObjectSize > 0 && size > c.MaxObjectSize {
+		return objectTooBig
+	}
+	if size < c.MinObjectSize {
+		return objectTooSmall
+	}
+	return ""
+}
+
+// maxObjectReader limits body by max_object_size, body bigger than limit could be detected by objectSizeSkipReason
+func (c *Config) maxObjectReader(body io.Reader) io.Reader {
+	if c.MaxObjectSize <= 0 {
+		return body
+	}
+	return io.LimitReader(body, c.MaxObjectSize+1)
+}
+
+func skipObject(log *zap.Logger, reason string) {
+	metrics.SkippedObjects.WithLabelValues(reason).Inc()
+	log.With(zap.String("reason", reason)).Debug("object size is not allowed, response is not saved")
+}
+
+// ioCopyWithPersist streams src to dst while body is accumulated into buffer.
+// Returns false if body should not be persisted: it is bigger than maxSize (0 means unlimited),
+// client is gone or src is broken.
+func ioCopyWithPersist(dst io.Writer, src io.Reader, buffer *bytes.Buffer, maxSize int64) (bool, error) {
+	persist := &persistBuffer{buffer: buffer, maxSize: maxSize}
+	if err := ioCopy(dst, io.TeeReader(src, persist)); err != nil {
+		return false, err
+	}
+	return !persist.overflow, nil
+}
+
+// persistBuffer accumulates body till maxSize, after that body is only streamed
+type persistBuffer struct {
+	buffer   *bytes.Buffer
+	maxSize  int64
+	overflow bool
+}
+
+func (b *persistBuffer) Write(p []byte) (int, error) {
+	if b.overflow {
+		return len(p), nil
+	}
+	if b.maxSize > 0 && int64(b.buffer.Len()+len(p)) > b.maxSize {
+		b.overflow = true
+		b.buffer.Reset()
+		return len(p), nil
+	}
+	return b.buffer.Write(p)
+}
@@ -0,0 +1,166 @@
+package compression
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"github.com/paragor/simple_cdn/pkg/utils/qvalue"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// content codings https://www.iana.org/assignments/http-parameters/http-parameters.xhtml#content-coding
+const (
+	Gzip   = "gzip"
+	Brotli = "br"
+	Zstd   = "zstd"
+)
+
+// Supported is list of content codings in order of preference
+var Supported = []string{Zstd, Brotli, Gzip}
+
+const brotliLevel = 5
+
+func IsSupported(encoding string) bool {
+	for _, supported := range Supported {
+		if encoding == supported {
+			return true
+		}
+	}
+	return false
+}
+
+// Negotiate returns best content coding from Accept-Encoding header, on equal q-values first of available wins.
+// Empty string means identity.
+func Negotiate(acceptEncoding string, available []string) string {
+	weights := make(map[string]float64)
+	starWeight := -1.0
+	for _, value := range qvalue.Parse(acceptEncoding) {
+		if value.Value == "*" {
+			starWeight = value.Quality
+			continue
+		}
+		weights[value.Value] = value.Quality
+	}
+	best := ""
+	bestWeight := 0.0
+	for _, coding := range available {
+		weight, ok := weights[coding]
+		if !ok {
+			weight = starWeight
+		}
+		if weight > bestWeight {
+			best = coding
+			bestWeight = weight
+		}
+	}
+	return best
+}
+
+// SetHeaders turns headers of identity response into headers of encoded one
+func SetHeaders(header http.Header, encoding string) {
+	header.Del("Content-Length")
+	header.Set("Content-Encoding", encoding)
+	// strong validator is not valid for other representation
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+}
+
+var gzipWriters = sync.Pool{New: func() any { return gzip.NewWriter(nil) }}
+var brotliWriters = sync.Pool{New: func() any { return brotli.NewWriterLevel(nil, brotliLevel) }}
+var zstdWriters = sync.Pool{New: func() any {
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		panic("cant init zstd encoder " + err.Error())
+	}
+	return encoder
+}}
+
+type pooledWriter struct {
+	encoder interface {
+		io.WriteCloser
+		Reset(w io.Writer)
+		Flush() error
+	}
+	pool   *sync.Pool
+	closed bool
+	// flushOnWrite - encoded data is flushed on every write, so streamed body is not held by encoder
+	flushOnWrite bool
+}
+
+func (w *pooledWriter) Write(p []byte) (int, error) {
+	n, err := w.encoder.Write(p)
+	if err != nil || !w.flushOnWrite {
+		return n, err
+	}
+	return n, w.encoder.Flush()
+}
+
+// Close flushes encoded data, encoder is returned to pool
+func (w *pooledWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	err := w.encoder.Close()
+	w.encoder.Reset(nil)
+	w.pool.Put(w.encoder)
+	return err
+}
+
+// NewWriter returns writer which encodes data to w, Close should be called to flush data
+func NewWriter(encoding string, w io.Writer) (io.WriteCloser, error) {
+	return newPooledWriter(encoding, w)
+}
+
+// NewStreamingWriter is NewWriter which flushes encoded data on every write, so every written chunk
+// is sent to client as soon as it is received
+func NewStreamingWriter(encoding string, w io.Writer) (io.WriteCloser, error) {
+	writer, err := newPooledWriter(encoding, w)
+	if err != nil {
+		return nil, err
+	}
+	writer.flushOnWrite = true
+	return writer, nil
+}
+
+func newPooledWriter(encoding string, w io.Writer) (*pooledWriter, error) {
+	var writer *pooledWriter
+	switch encoding {
+	case Gzip:
+		encoder := gzipWriters.Get().(*gzip.Writer)
+		writer = &pooledWriter{encoder: encoder, pool: &gzipWriters}
+	case Brotli:
+		encoder := brotliWriters.Get().(*brotli.Writer)
+		writer = &pooledWriter{encoder: encoder, pool: &brotliWriters}
+	case Zstd:
+		encoder := zstdWriters.Get().(*zstd.Encoder)
+		writer = &pooledWriter{encoder: encoder, pool: &zstdWriters}
+	default:
+		return nil, fmt.Errorf("unsupported content coding: %s", encoding)
+	}
+	writer.encoder.Reset(w)
+	return writer, nil
+}
+
+// Encode returns body encoded by content coding
+func Encode(encoding string, body []byte) ([]byte, error) {
+	buffer := bytes.NewBuffer(make([]byte, 0, len(body)/2))
+	writer, err := NewWriter(encoding, buffer)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := writer.Write(body); err != nil {
+		_ = writer.Close()
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,120 @@
+package compression
+
+import (
+	"bytes"
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		available      []string
+		want           string
+	}{
+		{name: "empty", acceptEncoding: "", available: Supported, want: ""},
+		{name: "only gzip", acceptEncoding: "gzip", available: Supported, want: Gzip},
+		{name: "server preference", acceptEncoding: "gzip, deflate, br, zstd", available: Supported, want: Zstd},
+		{name: "q-values", acceptEncoding: "gzip;q=1.0, br;q=0.8, zstd;q=0.5", available: Supported, want: Gzip},
+		{name: "disabled by q=0", acceptEncoding: "zstd;q=0, br", available: Supported, want: Brotli},
+		{name: "star", acceptEncoding: "gzip;q=0.5, *", available: Supported, want: Zstd},
+		{name: "star disabled", acceptEncoding: "*;q=0", available: Supported, want: ""},
+		{name: "not available", acceptEncoding: "zstd", available: []string{Gzip}, want: ""},
+		{name: "case and spaces", acceptEncoding: " GZIP ; Q=0.9 ", available: Supported, want: Gzip},
+		{name: "identity only", acceptEncoding: "identity", available: Supported, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Negotiate(tt.acceptEncoding, tt.available); got != tt.want {
+				t.Errorf("Negotiate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncode(t *testing.T) {
+	body := bytes.Repeat([]byte("<html>hello world</html>"), 100)
+	decoders := map[string]func(r io.Reader) (io.Reader, error){
+		Gzip: func(r io.Reader) (io.Reader, error) {
+			return gzip.NewReader(r)
+		},
+		Brotli: func(r io.Reader) (io.Reader, error) {
+			return brotli.NewReader(r), nil
+		},
+		Zstd: func(r io.Reader) (io.Reader, error) {
+			return zstd.NewReader(r)
+		},
+	}
+	for _, encoding := range Supported {
+		t.Run(encoding, func(t *testing.T) {
+			// twice to check pooled encoders
+			for i := 0; i < 2; i++ {
+				encoded, err := Encode(encoding, body)
+				if err != nil {
+					t.Fatalf("cant encode: %s", err)
+				}
+				if len(encoded) >= len(body) {
+					t.Errorf("body is not compressed: %d >= %d", len(encoded), len(body))
+				}
+				reader, err := decoders[encoding](bytes.NewReader(encoded))
+				if err != nil {
+					t.Fatalf("cant decode: %s", err)
+				}
+				decoded, err := io.ReadAll(reader)
+				if err != nil {
+					t.Fatalf("cant decode: %s", err)
+				}
+				if !bytes.Equal(decoded, body) {
+					t.Errorf("decoded body is not equal to original")
+				}
+			}
+		})
+	}
+	if _, err := Encode("deflate", body); err == nil {
+		t.Errorf("unsupported content coding should return error")
+	}
+}
+
+func TestNewStreamingWriter(t *testing.T) {
+	chunk := []byte("<html>first chunk</html>")
+	decoders := map[string]func(r io.Reader) (io.Reader, error){
+		Gzip: func(r io.Reader) (io.Reader, error) {
+			return gzip.NewReader(r)
+		},
+		Brotli: func(r io.Reader) (io.Reader, error) {
+			return brotli.NewReader(r), nil
+		},
+		Zstd: func(r io.Reader) (io.Reader, error) {
+			return zstd.NewReader(r)
+		},
+	}
+	for _, encoding := range Supported {
+		t.Run(encoding, func(t *testing.T) {
+			buffer := bytes.NewBuffer(nil)
+			writer, err := NewStreamingWriter(encoding, buffer)
+			if err != nil {
+				t.Fatalf("cant create writer: %s", err)
+			}
+			defer writer.Close()
+			if _, err := writer.Write(chunk); err != nil {
+				t.Fatalf("cant write: %s", err)
+			}
+			// chunk is decodable before writer is closed
+			reader, err := decoders[encoding](bytes.NewReader(buffer.Bytes()))
+			if err != nil {
+				t.Fatalf("cant decode: %s", err)
+			}
+			decoded := make([]byte, len(chunk))
+			if _, err := io.ReadFull(reader, decoded); err != nil {
+				t.Fatalf("cant decode flushed chunk: %s", err)
+			}
+			if !bytes.Equal(decoded, chunk) {
+				t.Errorf("decoded chunk is not equal to original")
+			}
+		})
+	}
+}
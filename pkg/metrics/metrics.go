@@ -7,6 +7,20 @@ var (
 	CacheErrors           prometheus.Counter
 	CacheInvalidations    prometheus.Counter
 	CacheInvalidatedItems prometheus.Counter
+	CacheRevalidations    *prometheus.CounterVec
+	CollapsedRequests     *prometheus.CounterVec
+	RevalidationLocks     *prometheus.CounterVec
+	BackgroundQueueDepth  prometheus.Gauge
+	BackgroundDroppedJobs *prometheus.CounterVec
+	BackgroundJobLatency  *prometheus.HistogramVec
+	EarlyRefreshes        prometheus.Counter
+	CompressedResponses   *prometheus.CounterVec
+	SkippedObjects        *prometheus.CounterVec
+	UpstreamHealthy       *prometheus.GaugeVec
+	UpstreamHealthChecks  *prometheus.CounterVec
+	UpstreamEjections     *prometheus.CounterVec
+	UpstreamFailovers     *prometheus.CounterVec
+	UpstreamRetries       *prometheus.CounterVec
 )
 
 func Init(app string) {
@@ -37,6 +51,104 @@ func Init(app string) {
 		Help:      "cache_load_time",
 	}, []string{"cache_status"})
 	prometheus.MustRegister(CacheLoadTime)
+
+	CacheRevalidations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: app,
+		Name:      "cache_revalidations",
+		Help:      "cache_revalidations",
+	}, []string{"result"})
+	prometheus.MustRegister(CacheRevalidations)
+
+	CollapsedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: app,
+		Name:      "collapsed_requests",
+		Help:      "collapsed_requests",
+	}, []string{"result"})
+	prometheus.MustRegister(CollapsedRequests)
+
+	EarlyRefreshes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: app,
+		Name:      "early_refreshes",
+		Help:      "early_refreshes",
+	})
+	prometheus.MustRegister(EarlyRefreshes)
+
+	CompressedResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: app,
+		Name:      "compressed_responses",
+		Help:      "compressed_responses",
+	}, []string{"encoding", "source"})
+	prometheus.MustRegister(CompressedResponses)
+
+	SkippedObjects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: app,
+		Name:      "cache_skipped_objects",
+		Help:      "cache_skipped_objects",
+	}, []string{"reason"})
+	prometheus.MustRegister(SkippedObjects)
+
+	UpstreamHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: app,
+		Name:      "upstream_healthy",
+		Help:      "upstream_healthy",
+	}, []string{"target", "group"})
+	prometheus.MustRegister(UpstreamHealthy)
+
+	UpstreamHealthChecks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: app,
+		Name:      "upstream_health_checks",
+		Help:      "upstream_health_checks",
+	}, []string{"target", "group", "result"})
+	prometheus.MustRegister(UpstreamHealthChecks)
+
+	UpstreamEjections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: app,
+		Name:      "upstream_ejections",
+		Help:      "upstream_ejections",
+	}, []string{"target", "reason"})
+	prometheus.MustRegister(UpstreamEjections)
+
+	UpstreamFailovers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: app,
+		Name:      "upstream_failovers",
+		Help:      "upstream_failovers",
+	}, []string{"reason"})
+	prometheus.MustRegister(UpstreamFailovers)
+
+	UpstreamRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: app,
+		Name:      "upstream_retries",
+		Help:      "upstream_retries",
+	}, []string{"reason"})
+	prometheus.MustRegister(UpstreamRetries)
+
+	RevalidationLocks = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: app,
+		Name:      "revalidation_locks",
+		Help:      "revalidation_locks",
+	}, []string{"result"})
+	prometheus.MustRegister(RevalidationLocks)
+
+	BackgroundQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: app,
+		Name:      "background_queue_depth",
+		Help:      "background_queue_depth",
+	})
+	prometheus.MustRegister(BackgroundQueueDepth)
+
+	BackgroundDroppedJobs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: app,
+		Name:      "background_dropped_jobs",
+		Help:      "background_dropped_jobs",
+	}, []string{"kind", "reason"})
+	prometheus.MustRegister(BackgroundDroppedJobs)
+
+	BackgroundJobLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: app,
+		Name:      "background_job_latency",
+		Help:      "background_job_latency",
+	}, []string{"kind"})
+	prometheus.MustRegister(BackgroundJobLatency)
 }
 
 func BoolToString(value bool, trueString, falseString string) string {
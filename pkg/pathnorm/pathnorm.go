@@ -0,0 +1,220 @@
+package pathnorm
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	TrailingSlashKeep   = "keep"
+	TrailingSlashAdd    = "add"
+	TrailingSlashRemove = "remove"
+)
+
+type Config struct {
+	// MergeSlashes - /a//b is /a/b
+	MergeSlashes bool `yaml:"merge_slashes"`
+	// ResolveDotSegments - /a/./b/../c is /a/c
+	ResolveDotSegments bool `yaml:"resolve_dot_segments"`
+	// Lowercase - /A/B is /a/b
+	Lowercase bool `yaml:"lowercase"`
+	// TrailingSlash - keep (default), add or remove trailing slash, slash is not added to paths with file extension
+	TrailingSlash string `yaml:"trailing_slash"`
+	// DecodeUnreserved - /%61%2D%2f is /a-%2F, percent-encoded unreserved chars are decoded, others are uppercased
+	DecodeUnreserved bool `yaml:"decode_unreserved"`
+	// ApplyToUpstream - upstream gets normalized path, otherwise original path is sent
+	ApplyToUpstream bool `yaml:"apply_to_upstream"`
+}
+
+func (c *Config) Validate() error {
+	if c.TrailingSlash != "" &&
+		c.TrailingSlash != TrailingSlashKeep &&
+		c.TrailingSlash != TrailingSlashAdd &&
+		c.TrailingSlash != TrailingSlashRemove {
+		return fmt.Errorf("trailing_slash should have value %s, %s or %s", TrailingSlashKeep, TrailingSlashAdd, TrailingSlashRemove)
+	}
+	return nil
+}
+
+func (c *Config) enabled() bool {
+	return c.MergeSlashes ||
+		c.ResolveDotSegments ||
+		c.Lowercase ||
+		c.DecodeUnreserved ||
+		c.TrailingSlash == TrailingSlashAdd ||
+		c.TrailingSlash == TrailingSlashRemove
+}
+
+// Normalize returns normalized escaped path
+func (c *Config) Normalize(escapedPath string) string {
+	path := escapedPath
+	if c.DecodeUnreserved {
+		path = decodeUnreserved(path)
+	}
+	if c.Lowercase {
+		path = lowercase(path)
+	}
+	if c.MergeSlashes {
+		path = mergeSlashes(path)
+	}
+	if c.ResolveDotSegments {
+		path = removeDotSegments(path)
+	}
+	switch c.TrailingSlash {
+	case TrailingSlashAdd:
+		lastSegment := path[strings.LastIndex(path, "/")+1:]
+		if !strings.HasSuffix(path, "/") && !strings.Contains(lastSegment, ".") {
+			path += "/"
+		}
+	case TrailingSlashRemove:
+		if trimmed := strings.TrimRight(path, "/"); trimmed != path {
+			path = trimmed
+			if path == "" {
+				path = "/"
+			}
+		}
+	}
+	return path
+}
+
+type upstreamPathKey struct{}
+
+type upstreamPath struct {
+	path    string
+	rawPath string
+}
+
+// Middleware normalizes path of request once, so matchers, cache key and upstream get the same path
+func (c *Config) Middleware(next http.Handler) http.Handler {
+	if !c.enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		escapedPath := r.URL.EscapedPath()
+		normalized := c.Normalize(escapedPath)
+		if normalized == escapedPath {
+			next.ServeHTTP(w, r)
+			return
+		}
+		path, err := url.PathUnescape(normalized)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		if !c.ApplyToUpstream {
+			ctx = context.WithValue(ctx, upstreamPathKey{}, upstreamPath{path: r.URL.Path, rawPath: r.URL.RawPath})
+		}
+		r = r.Clone(ctx)
+		r.URL.Path = path
+		r.URL.RawPath = normalized
+		next.ServeHTTP(w, r)
+	})
+}
+
+// UpstreamPath returns original path of request if normalized path should not be sent to upstream
+func UpstreamPath(ctx context.Context) (path string, rawPath string, ok bool) {
+	original, ok := ctx.Value(upstreamPathKey{}).(upstreamPath)
+	return original.path, original.rawPath, ok
+}
+
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' ||
+		'A' <= c && c <= 'Z' ||
+		'0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+func decodeUnreserved(path string) string {
+	if !strings.Contains(path, "%") {
+		return path
+	}
+	result := &strings.Builder{}
+	result.Grow(len(path))
+	for i := 0; i < len(path); i++ {
+		if path[i] != '%' || i+2 >= len(path) {
+			result.WriteByte(path[i])
+			continue
+		}
+		high, highOk := unhex(path[i+1])
+		low, lowOk := unhex(path[i+2])
+		if !highOk || !lowOk {
+			result.WriteByte(path[i])
+			continue
+		}
+		if decoded := high<<4 | low; isUnreserved(decoded) {
+			result.WriteByte(decoded)
+		} else {
+			result.WriteString("%" + strings.ToUpper(path[i+1:i+3]))
+		}
+		i += 2
+	}
+	return result.String()
+}
+
+// lowercase lowers path, hex digits of percent-encoded chars are left as is
+func lowercase(path string) string {
+	if !strings.Contains(path, "%") {
+		return strings.ToLower(path)
+	}
+	result := []byte(path)
+	for i := 0; i < len(result); i++ {
+		if result[i] == '%' {
+			i += 2
+			continue
+		}
+		if 'A' <= result[i] && result[i] <= 'Z' {
+			result[i] += 'a' - 'A'
+		}
+	}
+	return string(result)
+}
+
+func mergeSlashes(path string) string {
+	for strings.Contains(path, "//") {
+		path = strings.ReplaceAll(path, "//", "/")
+	}
+	return path
+}
+
+// removeDotSegments is remove_dot_segments of rfc3986 section 5.2.4
+func removeDotSegments(path string) string {
+	if !strings.Contains(path, ".") {
+		return path
+	}
+	segments := strings.Split(path, "/")
+	result := make([]string, 0, len(segments))
+	for i, segment := range segments {
+		last := i == len(segments)-1
+		switch segment {
+		case ".":
+		case "..":
+			// first segment is empty for absolute path
+			if len(result) > 1 {
+				result = result[:len(result)-1]
+			}
+		default:
+			result = append(result, segment)
+			continue
+		}
+		if last {
+			result = append(result, "")
+		}
+	}
+	return strings.Join(result, "/")
+}
@@ -0,0 +1,162 @@
+package pathnorm
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConfig_Normalize(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		path   string
+		want   string
+	}{
+		{
+			name:   "disabled",
+			config: Config{},
+			path:   "//a/./b/../C/",
+			want:   "//a/./b/../C/",
+		},
+		{
+			name:   "merge slashes",
+			config: Config{MergeSlashes: true},
+			path:   "///a//b///c",
+			want:   "/a/b/c",
+		},
+		{
+			name:   "dot segments",
+			config: Config{ResolveDotSegments: true},
+			path:   "/a/./b/../c",
+			want:   "/a/c",
+		},
+		{
+			name:   "dot segments at the end",
+			config: Config{ResolveDotSegments: true},
+			path:   "/a/b/..",
+			want:   "/a/",
+		},
+		{
+			name:   "dot segments above root",
+			config: Config{ResolveDotSegments: true},
+			path:   "/../../a",
+			want:   "/a",
+		},
+		{
+			name:   "dots in names",
+			config: Config{ResolveDotSegments: true},
+			path:   "/a/.b/c../file.js",
+			want:   "/a/.b/c../file.js",
+		},
+		{
+			name:   "lowercase",
+			config: Config{Lowercase: true},
+			path:   "/A/Bc",
+			want:   "/a/bc",
+		},
+		{
+			name:   "lowercase keeps escapes",
+			config: Config{Lowercase: true},
+			path:   "/A%2FB",
+			want:   "/a%2Fb",
+		},
+		{
+			name:   "decode unreserved",
+			config: Config{DecodeUnreserved: true},
+			path:   "/%61%2D%7e/%2f%20/%zz/%4",
+			want:   "/a-~/%2F%20/%zz/%4",
+		},
+		{
+			name:   "decoded dot segments are resolved",
+			config: Config{DecodeUnreserved: true, ResolveDotSegments: true},
+			path:   "/a/%2E%2E/b",
+			want:   "/b",
+		},
+		{
+			name:   "add trailing slash",
+			config: Config{TrailingSlash: TrailingSlashAdd},
+			path:   "/a/b",
+			want:   "/a/b/",
+		},
+		{
+			name:   "add trailing slash skips files",
+			config: Config{TrailingSlash: TrailingSlashAdd},
+			path:   "/a/b.css",
+			want:   "/a/b.css",
+		},
+		{
+			name:   "remove trailing slash",
+			config: Config{TrailingSlash: TrailingSlashRemove},
+			path:   "/a/b//",
+			want:   "/a/b",
+		},
+		{
+			name:   "remove trailing slash keeps root",
+			config: Config{TrailingSlash: TrailingSlashRemove},
+			path:   "/",
+			want:   "/",
+		},
+		{
+			name: "all",
+			config: Config{
+				MergeSlashes:       true,
+				ResolveDotSegments: true,
+				Lowercase:          true,
+				DecodeUnreserved:   true,
+				TrailingSlash:      TrailingSlashRemove,
+			},
+			path: "//Static/./JS/..//%41pp/",
+			want: "/static/app",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.Validate(); err != nil {
+				t.Fatalf("Validate() error = %v", err)
+			}
+			if got := tt.config.Normalize(tt.path); got != tt.want {
+				t.Errorf("Normalize() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfig_Middleware(t *testing.T) {
+	tests := []struct {
+		name              string
+		applyToUpstream   bool
+		wantUpstreamPath  string
+		wantUpstreamFound bool
+	}{
+		{
+			name:              "original path for upstream",
+			applyToUpstream:   false,
+			wantUpstreamPath:  "/a//B",
+			wantUpstreamFound: true,
+		},
+		{
+			name:              "normalized path for upstream",
+			applyToUpstream:   true,
+			wantUpstreamFound: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{MergeSlashes: true, Lowercase: true, ApplyToUpstream: tt.applyToUpstream}
+			var gotPath, gotUpstreamPath string
+			var gotUpstreamFound bool
+			handler := config.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				gotPath = r.URL.Path
+				gotUpstreamPath, _, gotUpstreamFound = UpstreamPath(r.Context())
+			}))
+			handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/a//B?q=1", nil))
+			if gotPath != "/a/b" {
+				t.Errorf("path = %v, want /a/b", gotPath)
+			}
+			if gotUpstreamFound != tt.wantUpstreamFound || gotUpstreamPath != tt.wantUpstreamPath {
+				t.Errorf("UpstreamPath() = %v %v, want %v %v", gotUpstreamPath, gotUpstreamFound, tt.wantUpstreamPath, tt.wantUpstreamFound)
+			}
+		})
+	}
+}
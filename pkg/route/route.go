@@ -0,0 +1,176 @@
+package route
+
+import (
+	"fmt"
+	"github.com/paragor/simple_cdn/pkg/cache"
+	"github.com/paragor/simple_cdn/pkg/cachebehavior"
+	"github.com/paragor/simple_cdn/pkg/upstream"
+	"github.com/paragor/simple_cdn/pkg/user"
+	"net/http"
+	"strings"
+)
+
+// Config is cache behavior of part of site, empty fields are inherited from site
+type Config struct {
+	Name string `yaml:"name"`
+	// PathPrefix - path of request should start with prefix, e.g. /static/
+	PathPrefix string `yaml:"path_prefix"`
+	// User - request should match user, both path_prefix and user are checked if they are specified
+	User *user.Config `yaml:"user,omitempty"`
+
+	CanPersistCache             *user.Config                                     `yaml:"can_persist_cache,omitempty"`
+	CanLoadCache                *user.Config                                     `yaml:"can_load_cache,omitempty"`
+	CacheKeyConfig              *cache.KeyConfig                                 `yaml:"cache_key_config,omitempty"`
+	Upstream                    *upstream.Config                                 `yaml:"upstream,omitempty"`
+	OrderedCacheControlFallback *cachebehavior.OrderedCacheControlFallbackConfig `yaml:"ordered_cache_control_fallback,omitempty"`
+}
+
+func (c *Config) Validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("name is empty")
+	}
+	if c.PathPrefix == "" && c.User == nil {
+		return fmt.Errorf("path_prefix or user should be specified")
+	}
+	if c.PathPrefix != "" && !strings.HasPrefix(c.PathPrefix, "/") {
+		return fmt.Errorf("path_prefix should start with /")
+	}
+	if c.User != nil {
+		if err := c.User.Validate(); err != nil {
+			return fmt.Errorf("user invalid: %w", err)
+		}
+	}
+	if c.CanPersistCache != nil {
+		if err := c.CanPersistCache.Validate(); err != nil {
+			return fmt.Errorf("can_persist_cache invalid: %w", err)
+		}
+	}
+	if c.CanLoadCache != nil {
+		if err := c.CanLoadCache.Validate(); err != nil {
+			return fmt.Errorf("can_load_cache invalid: %w", err)
+		}
+	}
+	if c.CacheKeyConfig != nil {
+		if err := c.CacheKeyConfig.Validate(); err != nil {
+			return fmt.Errorf("cache_key_config invalid: %w", err)
+		}
+	}
+	if c.Upstream != nil {
+		if err := c.Upstream.Validate(); err != nil {
+			return fmt.Errorf("upstream invalid: %w", err)
+		}
+	}
+	if c.OrderedCacheControlFallback != nil {
+		if err := c.OrderedCacheControlFallback.Validate(); err != nil {
+			return fmt.Errorf("ordered_cache_control_fallback invalid: %w", err)
+		}
+	}
+	return nil
+}
+
+// ValidateList validates ordered list of behaviors
+func ValidateList(configs []Config) error {
+	names := map[string]struct{}{}
+	for i := range configs {
+		if err := configs[i].Validate(); err != nil {
+			return fmt.Errorf("%d invalid: %w", i, err)
+		}
+		if _, exists := names[configs[i].Name]; exists {
+			return fmt.Errorf("%d invalid: duplicate name %s", i, configs[i].Name)
+		}
+		names[configs[i].Name] = struct{}{}
+	}
+	return nil
+}
+
+// Defaults are settings of site which are inherited by behaviors
+type Defaults struct {
+	// Name of site, upstreams of behaviors are named by it in metrics
+	Name                        string
+	CanPersistCache             *user.Config
+	CanLoadCache                *user.Config
+	CacheKeyConfig              *cache.KeyConfig
+	Upstream                    upstream.Upstream
+	OrderedCacheControlFallback *cachebehavior.OrderedCacheControlFallbackConfig
+	// CacheBehavior is shared, so behaviors use background pool of site, it must not be shared by sites
+	CacheBehavior *cachebehavior.Config
+}
+
+// Handler returns handler of site, default is used if there are no behaviors
+func (d *Defaults) Handler(cacheDb cache.Cache) http.Handler {
+	return cachebehavior.NewCacheBehavior(
+		d.CanPersistCache.ToUser(),
+		d.CanLoadCache.ToUser(),
+		d.CacheKeyConfig,
+		d.Upstream,
+		cacheDb,
+		d.OrderedCacheControlFallback.ToCacheControlParser(),
+		d.CacheBehavior,
+	)
+}
+
+func (c *Config) handler(defaults *Defaults, cacheDb cache.Cache) http.Handler {
+	merged := *defaults
+	if c.CanPersistCache != nil {
+		merged.CanPersistCache = c.CanPersistCache
+	}
+	if c.CanLoadCache != nil {
+		merged.CanLoadCache = c.CanLoadCache
+	}
+	if c.CacheKeyConfig != nil {
+		merged.CacheKeyConfig = c.CacheKeyConfig
+	}
+	if c.Upstream != nil {
+		merged.Upstream = c.Upstream.CreateUpstream(defaults.Name + "/" + c.Name)
+	}
+	if c.OrderedCacheControlFallback != nil {
+		merged.OrderedCacheControlFallback = c.OrderedCacheControlFallback
+	}
+	return merged.Handler(cacheDb)
+}
+
+type route struct {
+	pathPrefix string
+	user       user.User
+	handler    http.Handler
+}
+
+func (r *route) match(request *http.Request) bool {
+	if r.pathPrefix != "" && !strings.HasPrefix(request.URL.Path, r.pathPrefix) {
+		return false
+	}
+	return r.user == nil || r.user.IsUser(request)
+}
+
+// Table serves request by first matched behavior, unmatched requests are served by site defaults
+type Table struct {
+	routes      []route
+	defaultSite http.Handler
+}
+
+// NewTable returns handler of site with ordered behaviors, configs should be valid
+func NewTable(configs []Config, defaults *Defaults, cacheDb cache.Cache) http.Handler {
+	table := &Table{defaultSite: defaults.Handler(cacheDb)}
+	if len(configs) == 0 {
+		return table.defaultSite
+	}
+	for i := range configs {
+		config := &configs[i]
+		compiled := route{pathPrefix: config.PathPrefix, handler: config.handler(defaults, cacheDb)}
+		if config.User != nil {
+			compiled.user = config.User.ToUser()
+		}
+		table.routes = append(table.routes, compiled)
+	}
+	return table
+}
+
+func (t *Table) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for i := range t.routes {
+		if t.routes[i].match(r) {
+			t.routes[i].handler.ServeHTTP(w, r)
+			return
+		}
+	}
+	t.defaultSite.ServeHTTP(w, r)
+}
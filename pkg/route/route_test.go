@@ -0,0 +1,74 @@
+package route
+
+import (
+	"github.com/paragor/simple_cdn/pkg/user"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type namedHandler string
+
+func (h namedHandler) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	_, _ = w.Write([]byte(h))
+}
+
+func TestTable_ServeHTTP(t *testing.T) {
+	table := &Table{
+		routes: []route{
+			{pathPrefix: "/api/", handler: namedHandler("api")},
+			{pathPrefix: "/static/", user: user.CookieExists("preview"), handler: namedHandler("static preview")},
+			{pathPrefix: "/static/", handler: namedHandler("static")},
+			{user: user.CookieExists("locale"), handler: namedHandler("pages")},
+		},
+		defaultSite: namedHandler("default"),
+	}
+	tests := []struct {
+		name    string
+		path    string
+		cookies []*http.Cookie
+		want    string
+	}{
+		{name: "prefix", path: "/api/v1/users", want: "api"},
+		{name: "prefix is not segment", path: "/apis", want: "default"},
+		{name: "first matched wins", path: "/static/app.js", cookies: []*http.Cookie{{Name: "preview", Value: "1"}}, want: "static preview"},
+		{name: "next prefix", path: "/static/app.js", want: "static"},
+		{name: "user only", path: "/about", cookies: []*http.Cookie{{Name: "locale", Value: "en"}}, want: "pages"},
+		{name: "nothing matched", path: "/about", want: "default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "http://example.com"+tt.path, nil)
+			for _, cookie := range tt.cookies {
+				request.AddCookie(cookie)
+			}
+			recorder := httptest.NewRecorder()
+			table.ServeHTTP(recorder, request)
+			if got := recorder.Body.String(); got != tt.want {
+				t.Errorf("behavior = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateList(t *testing.T) {
+	tests := []struct {
+		name    string
+		configs []Config
+		wantErr bool
+	}{
+		{name: "empty", configs: nil, wantErr: false},
+		{name: "valid", configs: []Config{{Name: "api", PathPrefix: "/api/"}}, wantErr: false},
+		{name: "without name", configs: []Config{{PathPrefix: "/api/"}}, wantErr: true},
+		{name: "without matcher", configs: []Config{{Name: "api"}}, wantErr: true},
+		{name: "relative prefix", configs: []Config{{Name: "api", PathPrefix: "api/"}}, wantErr: true},
+		{name: "duplicate name", configs: []Config{{Name: "api", PathPrefix: "/api/"}, {Name: "api", PathPrefix: "/v2/"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateList(tt.configs); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateList() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
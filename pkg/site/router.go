@@ -0,0 +1,72 @@
+package site
+
+import (
+	"github.com/paragor/simple_cdn/pkg/utils/hostnorm"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+type wildcardSite struct {
+	suffix  string
+	handler http.Handler
+}
+
+type patternSite struct {
+	pattern *regexp.Regexp
+	handler http.Handler
+}
+
+// Router chooses site by Host: exact hosts first, then the longest wildcard, then patterns in order of sites.
+// Unmatched hosts go to default site.
+type Router struct {
+	exact       map[string]http.Handler
+	wildcards   []wildcardSite
+	patterns    []patternSite
+	defaultSite http.Handler
+}
+
+func NewRouter(defaultSite http.Handler) *Router {
+	return &Router{exact: make(map[string]http.Handler), defaultSite: defaultSite}
+}
+
+// Add registers handler of site, config should be valid
+func (router *Router) Add(config *Config, handler http.Handler) {
+	for _, host := range config.Hosts {
+		host = strings.ToLower(host)
+		if suffix, isWildcard := strings.CutPrefix(host, "*"); isWildcard {
+			router.wildcards = append(router.wildcards, wildcardSite{suffix: suffix, handler: handler})
+			continue
+		}
+		router.exact[host] = handler
+	}
+	sort.SliceStable(router.wildcards, func(i, j int) bool {
+		return len(router.wildcards[i].suffix) > len(router.wildcards[j].suffix)
+	})
+	for _, pattern := range config.HostPatterns {
+		router.patterns = append(router.patterns, patternSite{pattern: regexp.MustCompile(pattern), handler: handler})
+	}
+}
+
+func (router *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	router.match(r.Host).ServeHTTP(w, r)
+}
+
+func (router *Router) match(host string) http.Handler {
+	host = hostnorm.Normalize(host)
+	if handler, ok := router.exact[host]; ok {
+		return handler
+	}
+	for _, wildcard := range router.wildcards {
+		if strings.HasSuffix(host, wildcard.suffix) {
+			return wildcard.handler
+		}
+	}
+	for _, pattern := range router.patterns {
+		if pattern.pattern.MatchString(host) {
+			return pattern.handler
+		}
+	}
+	return router.defaultSite
+}
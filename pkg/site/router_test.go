@@ -0,0 +1,69 @@
+package site
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type namedHandler string
+
+func (h namedHandler) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	_, _ = w.Write([]byte(h))
+}
+
+func TestRouter_match(t *testing.T) {
+	router := NewRouter(namedHandler("default"))
+	router.Add(&Config{Name: "exact", Hosts: []string{"Example.com", "www.example.com"}}, namedHandler("exact"))
+	router.Add(&Config{Name: "wildcard", Hosts: []string{"*.example.com"}}, namedHandler("wildcard"))
+	router.Add(&Config{Name: "longer wildcard", Hosts: []string{"*.static.example.com"}}, namedHandler("longer wildcard"))
+	router.Add(&Config{Name: "pattern", HostPatterns: []string{`^shop-\d+\.example\.org$`}}, namedHandler("pattern"))
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{host: "example.com", want: "exact"},
+		{host: "EXAMPLE.COM:8080", want: "exact"},
+		{host: "www.example.com.", want: "exact"},
+		{host: "blog.example.com", want: "wildcard"},
+		{host: "a.b.example.com", want: "wildcard"},
+		{host: "img.static.example.com", want: "longer wildcard"},
+		{host: "shop-12.example.org", want: "pattern"},
+		{host: "shop-x.example.org", want: "default"},
+		{host: "example.net", want: "default"},
+		{host: "", want: "default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "http://placeholder/", nil)
+			request.Host = tt.host
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, request)
+			if got := recorder.Body.String(); got != tt.want {
+				t.Errorf("site = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  *Config
+		wantErr bool
+	}{
+		{name: "without name", config: &Config{Hosts: []string{"example.com"}}, wantErr: true},
+		{name: "without hosts", config: &Config{Name: "site"}, wantErr: true},
+		{name: "wildcard in the middle", config: &Config{Name: "site", Hosts: []string{"a.*.com"}}, wantErr: true},
+		{name: "invalid pattern", config: &Config{Name: "site", HostPatterns: []string{"("}}, wantErr: true},
+		{name: "invalid namespace", config: &Config{Name: "my site", Hosts: []string{"example.com"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
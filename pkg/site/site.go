@@ -0,0 +1,113 @@
+package site
+
+import (
+	"fmt"
+	"github.com/paragor/simple_cdn/pkg/cache"
+	"github.com/paragor/simple_cdn/pkg/cachebehavior"
+	"github.com/paragor/simple_cdn/pkg/route"
+	"github.com/paragor/simple_cdn/pkg/upstream"
+	"github.com/paragor/simple_cdn/pkg/user"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+var namespaceRegexp = regexp.MustCompile("^[a-zA-Z0-9_.-]+$")
+
+// Config is virtual host with own upstream, cache key, rules and cache namespace
+type Config struct {
+	Name string `yaml:"name"`
+	// Hosts - exact hosts (example.com) or wildcards (*.example.com matches subdomains of any depth)
+	Hosts []string `yaml:"hosts,omitempty"`
+	// HostPatterns - regexps of host
+	HostPatterns []string `yaml:"host_patterns,omitempty"`
+	// CacheNamespace - prefix of cache keys, default is name
+	CacheNamespace string `yaml:"cache_namespace"`
+
+	CanPersistCache             user.Config                                     `yaml:"can_persist_cache"`
+	CanLoadCache                user.Config                                     `yaml:"can_load_cache"`
+	CacheKeyConfig              cache.KeyConfig                                 `yaml:"cache_key_config"`
+	Upstream                    upstream.Config                                 `yaml:"upstream"`
+	OrderedCacheControlFallback cachebehavior.OrderedCacheControlFallbackConfig `yaml:"ordered_cache_control_fallback"`
+	CacheBehavior               cachebehavior.Config                            `yaml:"cache_behavior"`
+	// Behaviors - ordered list of behaviors of site paths, first matched is used
+	Behaviors []route.Config `yaml:"behaviors"`
+}
+
+func (c *Config) Validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("name is empty")
+	}
+	if len(c.Hosts) == 0 && len(c.HostPatterns) == 0 {
+		return fmt.Errorf("hosts and host_patterns are empty")
+	}
+	for _, host := range c.Hosts {
+		if host == "" || strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+			return fmt.Errorf("hosts: invalid host %q, only leading *. is allowed", host)
+		}
+	}
+	for _, pattern := range c.HostPatterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return fmt.Errorf("host_patterns: %w", err)
+		}
+	}
+	if err := ValidateNamespace(c.Namespace()); err != nil {
+		return fmt.Errorf("cache_namespace %w", err)
+	}
+	if err := c.CanPersistCache.Validate(); err != nil {
+		return fmt.Errorf("can_persist_cache invalid: %w", err)
+	}
+	if err := c.CanLoadCache.Validate(); err != nil {
+		return fmt.Errorf("can_load_cache invalid: %w", err)
+	}
+	if err := c.CacheKeyConfig.Validate(); err != nil {
+		return fmt.Errorf("cache_key_config invalid: %w", err)
+	}
+	if err := c.Upstream.Validate(); err != nil {
+		return fmt.Errorf("upstream invalid: %w", err)
+	}
+	if err := c.OrderedCacheControlFallback.Validate(); err != nil {
+		return fmt.Errorf("ordered_cache_control_fallback invalid: %w", err)
+	}
+	if err := c.CacheBehavior.Validate(); err != nil {
+		return fmt.Errorf("cache_behavior invalid: %w", err)
+	}
+	if err := route.ValidateList(c.Behaviors); err != nil {
+		return fmt.Errorf("behaviors: %w", err)
+	}
+	return nil
+}
+
+// ValidateNamespace checks prefix of cache keys
+func ValidateNamespace(namespace string) error {
+	if !namespaceRegexp.MatchString(namespace) {
+		return fmt.Errorf("should match %s", namespaceRegexp.String())
+	}
+	return nil
+}
+
+// Namespace returns prefix of site cache keys
+func (c *Config) Namespace() string {
+	if c.CacheNamespace == "" {
+		return c.Name
+	}
+	return c.CacheNamespace
+}
+
+// Cache returns cache of site namespace in shared cache backend
+func (c *Config) Cache(cacheDb cache.Cache) cache.Cache {
+	return cache.NewNamespace(cacheDb, c.Namespace())
+}
+
+// Handler returns cache behaviors of site
+func (c *Config) Handler(cacheDb cache.Cache) http.Handler {
+	return route.NewTable(c.Behaviors, &route.Defaults{
+		Name:                        c.Name,
+		CanPersistCache:             &c.CanPersistCache,
+		CanLoadCache:                &c.CanLoadCache,
+		CacheKeyConfig:              &c.CacheKeyConfig,
+		Upstream:                    c.Upstream.CreateUpstream(c.Name),
+		OrderedCacheControlFallback: &c.OrderedCacheControlFallback,
+		CacheBehavior:               &c.CacheBehavior,
+	}, c.Cache(cacheDb))
+}
@@ -0,0 +1,77 @@
+package upstream
+
+import (
+	"bytes"
+	"github.com/paragor/simple_cdn/pkg/logger"
+	"github.com/paragor/simple_cdn/pkg/metrics"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+// FailoverHeader is set on response of failover upstream, value is index of upstream in failover list (from 1)
+const FailoverHeader = "X-Upstream-Failover"
+
+// failoverUpstream sends request to the next upstream on error or failover status of previous one.
+// Only idempotent requests fail over: failover status does not mean that request is not applied by upstream
+type failoverUpstream struct {
+	upstreams   []Upstream
+	statuses    []int
+	maxBodySize int64
+}
+
+func newFailoverUpstream(upstreams []Upstream, statuses []int, maxBodySize int64) Upstream {
+	return &failoverUpstream{upstreams: upstreams, statuses: statuses, maxBodySize: maxBodySize}
+}
+
+func (u *failoverUpstream) Do(originRequest *http.Request) (*http.Response, error) {
+	if !slices.Contains(idempotentMethods, originRequest.Method) {
+		return u.upstreams[0].Do(originRequest)
+	}
+	// body is replayed to every upstream
+	body, replayable, err := bufferBody(originRequest, u.maxBodySize)
+	if err != nil {
+		return nil, err
+	}
+	if !replayable {
+		// body is too big to keep it in memory, so request goes only to primary upstream
+		request := originRequest.Clone(originRequest.Context())
+		request.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), originRequest.Body))
+		return u.upstreams[0].Do(request)
+	}
+	log := logger.FromCtx(originRequest.Context()).With(zap.String("component", "failoverUpstream"))
+	for i, upstream := range u.upstreams {
+		request := originRequest.Clone(originRequest.Context())
+		request.Body = io.NopCloser(bytes.NewReader(body))
+		request.ContentLength = int64(len(body))
+		response, err := upstream.Do(request)
+		if i == len(u.upstreams)-1 {
+			return u.mark(response, i), err
+		}
+		switch {
+		case err != nil:
+			metrics.UpstreamFailovers.WithLabelValues("error").Inc()
+			log.With(zap.Error(err)).With(zap.Int("upstream", i)).Warn("failover on upstream error")
+		case slices.Contains(u.statuses, response.StatusCode):
+			metrics.UpstreamFailovers.WithLabelValues("status").Inc()
+			log.With(zap.Int("status", response.StatusCode)).With(zap.Int("upstream", i)).Warn("failover on upstream status")
+			_, _ = io.Copy(io.Discard, response.Body)
+			_ = response.Body.Close()
+		default:
+			return u.mark(response, i), nil
+		}
+	}
+	panic("failover upstream without upstreams")
+}
+
+func (u *failoverUpstream) mark(response *http.Response, index int) *http.Response {
+	if response != nil && index > 0 {
+		if response.Header == nil {
+			response.Header = http.Header{}
+		}
+		response.Header.Set(FailoverHeader, strconv.Itoa(index))
+	}
+	return response
+}
@@ -0,0 +1,133 @@
+package upstream
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type statusUpstream struct {
+	status int
+	err    error
+	bodies []string
+}
+
+func (u *statusUpstream) Do(r *http.Request) (*http.Response, error) {
+	body, _ := io.ReadAll(r.Body)
+	u.bodies = append(u.bodies, string(body))
+	if u.err != nil {
+		return nil, u.err
+	}
+	return &http.Response{StatusCode: u.status, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(""))}, nil
+}
+
+func TestFailoverUpstream_Do(t *testing.T) {
+	initMetricsAndLogs()
+	failure := errors.New("connection refused")
+	tests := []struct {
+		name         string
+		method       string
+		maxBodySize  int64
+		upstreams    []*statusUpstream
+		wantStatus   int
+		wantErr      bool
+		wantFailover string
+		wantRequests []int
+	}{
+		{
+			name:         "primary is ok",
+			upstreams:    []*statusUpstream{{status: 200}, {status: 200}},
+			wantStatus:   200,
+			wantRequests: []int{1, 0},
+		},
+		{
+			name:         "primary is not found",
+			upstreams:    []*statusUpstream{{status: 404}, {status: 200}},
+			wantStatus:   404,
+			wantRequests: []int{1, 0},
+		},
+		{
+			name:         "primary status",
+			upstreams:    []*statusUpstream{{status: 503}, {status: 200}},
+			wantStatus:   200,
+			wantFailover: "1",
+			wantRequests: []int{1, 1},
+		},
+		{
+			name:         "primary error",
+			upstreams:    []*statusUpstream{{err: failure}, {status: 502}, {status: 200}},
+			wantStatus:   200,
+			wantFailover: "2",
+			wantRequests: []int{1, 1, 1},
+		},
+		{
+			name:         "all failed with status",
+			upstreams:    []*statusUpstream{{status: 504}, {status: 502}},
+			wantStatus:   502,
+			wantFailover: "1",
+			wantRequests: []int{1, 1},
+		},
+		{
+			name:         "all failed with error",
+			upstreams:    []*statusUpstream{{status: 504}, {err: failure}},
+			wantErr:      true,
+			wantRequests: []int{1, 1},
+		},
+		{
+			name:         "not idempotent method",
+			method:       http.MethodPost,
+			upstreams:    []*statusUpstream{{status: 502}, {status: 200}},
+			wantStatus:   502,
+			wantRequests: []int{1, 0},
+		},
+		{
+			name:         "body is too big",
+			maxBodySize:  3,
+			upstreams:    []*statusUpstream{{status: 502}, {status: 200}},
+			wantStatus:   502,
+			wantRequests: []int{1, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstreams := make([]Upstream, 0, len(tt.upstreams))
+			for _, u := range tt.upstreams {
+				upstreams = append(upstreams, u)
+			}
+			method := tt.method
+			if method == "" {
+				method = http.MethodPut
+			}
+			maxBodySize := tt.maxBodySize
+			if maxBodySize == 0 {
+				maxBodySize = 1024
+			}
+			failover := newFailoverUpstream(upstreams, []int{502, 503, 504}, maxBodySize)
+			response, err := failover.Do(httptest.NewRequest(method, "/", strings.NewReader("payload")))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Do() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				if response.StatusCode != tt.wantStatus {
+					t.Errorf("status = %d, want %d", response.StatusCode, tt.wantStatus)
+				}
+				if got := response.Header.Get(FailoverHeader); got != tt.wantFailover {
+					t.Errorf("%s = %q, want %q", FailoverHeader, got, tt.wantFailover)
+				}
+			}
+			for i, u := range tt.upstreams {
+				if len(u.bodies) != tt.wantRequests[i] {
+					t.Errorf("upstream %d got %d requests, want %d", i, len(u.bodies), tt.wantRequests[i])
+				}
+				for _, body := range u.bodies {
+					if body != "payload" {
+						t.Errorf("upstream %d got body %q, want payload", i, body)
+					}
+				}
+			}
+		})
+	}
+}
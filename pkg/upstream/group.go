@@ -0,0 +1,334 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"github.com/cespare/xxhash/v2"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	BalancingRoundRobin       = "round_robin"
+	BalancingLeastOutstanding = "least_outstanding"
+	BalancingRandomTwoChoices = "random_two_choices"
+	BalancingConsistentHash   = "consistent_hash"
+)
+
+// consistentHashReplicas is count of points of target with weight 1 on hash ring
+const consistentHashReplicas = 100
+
+type TargetConfig struct {
+	Host string `yaml:"host"`
+	// Weight - share of requests of target, default is 1
+	Weight int `yaml:"weight"`
+}
+
+func (c *TargetConfig) Validate() error {
+	if c.Host == "" {
+		return fmt.Errorf("host can not be empty")
+	}
+	if c.Weight < 0 {
+		return fmt.Errorf("weight should be >= 0")
+	}
+	return nil
+}
+
+func (c *TargetConfig) weight() int {
+	if c.Weight == 0 {
+		return 1
+	}
+	return c.Weight
+}
+
+type target struct {
+	host        string
+	weight      int
+	upstream    Upstream
+	outstanding atomic.Int64
+	healthy     atomic.Bool
+	// checker is nil if health checks are disabled
+	checker *healthChecker
+
+	// ejectedUntil is unix nano time of ejection end, fields below are guarded by outlierDetector
+	ejectedUntil      atomic.Int64
+	ejections         int
+	consecutive5xx    int
+	consecutiveErrors int
+}
+
+func newTarget(host string, weight int, upstream Upstream) *target {
+	t := &target{host: host, weight: weight, upstream: upstream}
+	t.healthy.Store(true)
+	return t
+}
+
+// available returns true if target is in rotation
+func (t *target) available() bool {
+	return t.healthy.Load() && !t.ejected(time.Now())
+}
+
+// usable returns true if target is available and is not tried yet by request
+func (t *target) usable(tried []*target) bool {
+	return t.available() && !slices.Contains(tried, t)
+}
+
+func (t *target) ejected(now time.Time) bool {
+	return now.UnixNano() < t.ejectedUntil.Load()
+}
+
+// lessLoaded returns true if target have less outstanding requests per weight than other
+func (t *target) lessLoaded(other *target) bool {
+	return t.outstanding.Load()*int64(other.weight) < other.outstanding.Load()*int64(t.weight)
+}
+
+type balancer interface {
+	// pick returns available target except tried ones, nil if there are no such targets
+	pick(r *http.Request, tried []*target) *target
+}
+
+var balancers = map[string]func(targets []*target) balancer{
+	BalancingRoundRobin:       newRoundRobin,
+	BalancingLeastOutstanding: newLeastOutstanding,
+	BalancingRandomTwoChoices: newRandomTwoChoices,
+	BalancingConsistentHash:   newConsistentHash,
+}
+
+// groupUpstream balances requests between targets
+type groupUpstream struct {
+	targets  []*target
+	balancer balancer
+	// outliers is nil if outlier detection is disabled
+	outliers *outlierDetector
+	// retry is nil if retries are disabled
+	retry  *RetryConfig
+	budget *retryBudget
+}
+
+func newGroupUpstream(
+	targets []*target,
+	balancing string,
+	outlierDetection *OutlierDetectionConfig,
+	retry *RetryConfig,
+) Upstream {
+	newBalancer, ok := balancers[balancing]
+	if !ok {
+		newBalancer = newRoundRobin
+	}
+	group := &groupUpstream{targets: targets, balancer: newBalancer(targets)}
+	if outlierDetection != nil && outlierDetection.enabled() {
+		group.outliers = newOutlierDetector(outlierDetection, targets)
+	}
+	if retry != nil && retry.enabled() {
+		group.retry = retry
+		group.budget = newRetryBudget(retry.budgetPercent())
+	}
+	registerTargets(targets)
+	return group
+}
+
+func (g *groupUpstream) Do(originRequest *http.Request) (*http.Response, error) {
+	if g.retry == nil || !g.retry.retryable(originRequest) {
+		_, response, err := g.try(originRequest, nil)
+		return response, err
+	}
+	return g.doWithRetries(originRequest)
+}
+
+// try sends request to target which is not tried yet, the same target is used again if there is no other one
+func (g *groupUpstream) try(request *http.Request, tried []*target) (*target, *http.Response, error) {
+	chosen := g.balancer.pick(request, tried)
+	if chosen == nil && len(tried) > 0 {
+		chosen = g.balancer.pick(request, nil)
+	}
+	if chosen == nil {
+		return nil, nil, ErrNoHealthyTargets
+	}
+	chosen.outstanding.Add(1)
+	response, err := chosen.upstream.Do(request)
+	if g.outliers != nil {
+		status := 0
+		if response != nil {
+			status = response.StatusCode
+		}
+		g.outliers.record(chosen, status, err)
+	}
+	if err != nil || response == nil {
+		chosen.outstanding.Add(-1)
+		return chosen, response, err
+	}
+	// request is outstanding until body is read
+	response.Body = &outstandingBody{ReadCloser: response.Body, target: chosen}
+	return chosen, response, nil
+}
+
+type outstandingBody struct {
+	io.ReadCloser
+	target *target
+	once   sync.Once
+}
+
+func (b *outstandingBody) Close() error {
+	b.once.Do(func() {
+		b.target.outstanding.Add(-1)
+	})
+	return b.ReadCloser.Close()
+}
+
+type hashKeyCtxKey struct{}
+
+// WithHashKey sets key of consistent hash balancing (e.g. cache key), by default it is request uri
+func WithHashKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, hashKeyCtxKey{}, key)
+}
+
+func hashKey(r *http.Request) string {
+	if key, ok := r.Context().Value(hashKeyCtxKey{}).(string); ok {
+		return key
+	}
+	return r.URL.RequestURI()
+}
+
+// roundRobin is smooth weighted round-robin, targets are interleaved according to weights
+type roundRobin struct {
+	m       sync.Mutex
+	targets []*target
+	current []int
+}
+
+func newRoundRobin(targets []*target) balancer {
+	return &roundRobin{targets: targets, current: make([]int, len(targets))}
+}
+
+func (b *roundRobin) pick(_ *http.Request, tried []*target) *target {
+	b.m.Lock()
+	defer b.m.Unlock()
+	best := -1
+	total := 0
+	for i, t := range b.targets {
+		if !t.usable(tried) {
+			continue
+		}
+		b.current[i] += t.weight
+		total += t.weight
+		if best < 0 || b.current[i] > b.current[best] {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	b.current[best] -= total
+	return b.targets[best]
+}
+
+// leastOutstanding chooses target with least outstanding requests per weight, ties are rotated
+type leastOutstanding struct {
+	targets []*target
+	next    atomic.Uint64
+}
+
+func newLeastOutstanding(targets []*target) balancer {
+	return &leastOutstanding{targets: targets}
+}
+
+func (b *leastOutstanding) pick(_ *http.Request, tried []*target) *target {
+	offset := int(b.next.Add(1) % uint64(len(b.targets)))
+	var best *target
+	for i := 0; i < len(b.targets); i++ {
+		t := b.targets[(offset+i)%len(b.targets)]
+		if t.usable(tried) && (best == nil || t.lessLoaded(best)) {
+			best = t
+		}
+	}
+	return best
+}
+
+// randomTwoChoices chooses less loaded of two random targets (power of two choices)
+type randomTwoChoices struct {
+	targets []*target
+}
+
+func newRandomTwoChoices(targets []*target) balancer {
+	return &randomTwoChoices{targets: targets}
+}
+
+// random returns weighted random target of available ones except excluded
+func random(targets []*target, excluded []*target) *target {
+	totalWeight := 0
+	for _, t := range targets {
+		if t.usable(excluded) {
+			totalWeight += t.weight
+		}
+	}
+	if totalWeight == 0 {
+		return nil
+	}
+	point := rand.IntN(totalWeight)
+	for _, t := range targets {
+		if !t.usable(excluded) {
+			continue
+		}
+		if point < t.weight {
+			return t
+		}
+		point -= t.weight
+	}
+	return nil
+}
+
+func (b *randomTwoChoices) pick(_ *http.Request, tried []*target) *target {
+	first := random(b.targets, tried)
+	if first == nil {
+		return nil
+	}
+	second := random(b.targets, append(slices.Clip(tried), first))
+	if second != nil && second.lessLoaded(first) {
+		return second
+	}
+	return first
+}
+
+type ringPoint struct {
+	hash   uint64
+	target *target
+}
+
+// consistentHash chooses target by hash of key on ring, so the same key goes to the same target
+type consistentHash struct {
+	ring []ringPoint
+}
+
+func newConsistentHash(targets []*target) balancer {
+	ring := []ringPoint{}
+	for _, t := range targets {
+		for i := 0; i < t.weight*consistentHashReplicas; i++ {
+			ring = append(ring, ringPoint{hash: xxhash.Sum64String(t.host + "#" + strconv.Itoa(i)), target: t})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		return ring[i].hash < ring[j].hash
+	})
+	return &consistentHash{ring: ring}
+}
+
+func (b *consistentHash) pick(r *http.Request, tried []*target) *target {
+	hash := xxhash.Sum64String(hashKey(r))
+	i := sort.Search(len(b.ring), func(i int) bool {
+		return b.ring[i].hash >= hash
+	})
+	// the next available target on ring takes keys of unavailable one
+	for checked := 0; checked < len(b.ring); checked++ {
+		if t := b.ring[(i+checked)%len(b.ring)].target; t.usable(tried) {
+			return t
+		}
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package upstream
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type hostUpstream string
+
+func (u hostUpstream) Do(_ *http.Request) (*http.Response, error) {
+	return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(string(u)))}, nil
+}
+
+func createTargets(weights ...int) []*target {
+	targets := make([]*target, 0, len(weights))
+	for i, weight := range weights {
+		host := "host" + strconv.Itoa(i)
+		targets = append(targets, newTarget(host, weight, hostUpstream(host)))
+	}
+	return targets
+}
+
+func TestRoundRobin_pick(t *testing.T) {
+	targets := createTargets(1, 2, 3)
+	balancer := newRoundRobin(targets)
+	counts := map[string]int{}
+	sequence := []string{}
+	for i := 0; i < 6; i++ {
+		host := balancer.pick(nil, nil).host
+		counts[host]++
+		sequence = append(sequence, host)
+	}
+	if counts["host0"] != 1 || counts["host1"] != 2 || counts["host2"] != 3 {
+		t.Errorf("counts = %v, want by weights", counts)
+	}
+	// smooth round-robin interleaves targets
+	if sequence[0] == sequence[1] && sequence[1] == sequence[2] {
+		t.Errorf("sequence = %v, want interleaved", sequence)
+	}
+}
+
+func TestLeastOutstanding_pick(t *testing.T) {
+	targets := createTargets(1, 1, 2)
+	targets[0].outstanding.Store(1)
+	targets[1].outstanding.Store(0)
+	targets[2].outstanding.Store(1)
+	balancer := newLeastOutstanding(targets)
+	for i := 0; i < 3; i++ {
+		if got := balancer.pick(nil, nil).host; got != "host1" {
+			t.Errorf("pick() = %v, want host1", got)
+		}
+	}
+	targets[1].outstanding.Store(1)
+	// 1 outstanding request of weight 2 is the least load
+	if got := balancer.pick(nil, nil).host; got != "host2" {
+		t.Errorf("pick() = %v, want host2", got)
+	}
+}
+
+func TestRandomTwoChoices_pick(t *testing.T) {
+	targets := createTargets(1, 1)
+	targets[0].outstanding.Store(10)
+	balancer := newRandomTwoChoices(targets)
+	for i := 0; i < 10; i++ {
+		if got := balancer.pick(nil, nil).host; got != "host1" {
+			t.Errorf("pick() = %v, want host1", got)
+		}
+	}
+}
+
+func TestConsistentHash_pick(t *testing.T) {
+	balancer := newConsistentHash(createTargets(1, 1, 1))
+	counts := map[string]int{}
+	for i := 0; i < 3000; i++ {
+		request := httptest.NewRequest(http.MethodGet, "/item/"+strconv.Itoa(i), nil)
+		request = request.WithContext(WithHashKey(request.Context(), "key"+strconv.Itoa(i)))
+		host := balancer.pick(request, nil).host
+		if again := balancer.pick(request, nil).host; again != host {
+			t.Fatalf("pick() = %v and %v, want the same target for the same key", host, again)
+		}
+		counts[host]++
+	}
+	for host, count := range counts {
+		if count < 500 {
+			t.Errorf("%s got %d of 3000 keys, want balanced ring", host, count)
+		}
+	}
+
+	// keys of remaining targets are not moved if target is removed
+	reduced := newConsistentHash(createTargets(1, 1))
+	for i := 0; i < 300; i++ {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request = request.WithContext(WithHashKey(request.Context(), "key"+strconv.Itoa(i)))
+		if host := balancer.pick(request, nil).host; host != "host2" && reduced.pick(request, nil).host != host {
+			t.Errorf("key%d moved from %s", i, host)
+		}
+	}
+}
+
+func TestGroupUpstream_Do(t *testing.T) {
+	targets := createTargets(1)
+	group := newGroupUpstream(targets, "", nil, nil)
+	response, err := group.Do(httptest.NewRequest(http.MethodGet, "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := targets[0].outstanding.Load(); got != 1 {
+		t.Errorf("outstanding = %d before body close, want 1", got)
+	}
+	_ = response.Body.Close()
+	_ = response.Body.Close()
+	if got := targets[0].outstanding.Load(); got != 0 {
+		t.Errorf("outstanding = %d after body close, want 0", got)
+	}
+}
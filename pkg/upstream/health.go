@@ -0,0 +1,278 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/paragor/simple_cdn/pkg/logger"
+	"github.com/paragor/simple_cdn/pkg/metrics"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoHealthyTargets is returned without request to upstream if all targets are unhealthy
+var ErrNoHealthyTargets = errors.New("no healthy upstream targets")
+
+// healthCheckBodyLimit is max size of body which is matched by body_pattern
+const healthCheckBodyLimit = 64 * 1024
+
+type HealthCheckConfig struct {
+	// Path - path of health check request, health checks are disabled if path is empty
+	Path     string        `yaml:"path"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+	// ExpectedStatuses - healthy status codes, default is any 2xx
+	ExpectedStatuses []int `yaml:"expected_statuses,omitempty"`
+	// BodyPattern - regexp which should match body of healthy response
+	BodyPattern string `yaml:"body_pattern"`
+	// Rise - count of consecutive successful checks to mark target healthy
+	Rise int `yaml:"rise"`
+	// Fall - count of consecutive failed checks to mark target unhealthy
+	Fall int `yaml:"fall"`
+}
+
+func (c *HealthCheckConfig) Validate() error {
+	if c.Path == "" {
+		return nil
+	}
+	if !strings.HasPrefix(c.Path, "/") {
+		return fmt.Errorf("path should start with /")
+	}
+	if c.Interval < 0 {
+		return fmt.Errorf("interval should be >= 0")
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("timeout should be >= 0")
+	}
+	if c.Rise < 0 {
+		return fmt.Errorf("rise should be >= 0")
+	}
+	if c.Fall < 0 {
+		return fmt.Errorf("fall should be >= 0")
+	}
+	if _, err := regexp.Compile(c.BodyPattern); err != nil {
+		return fmt.Errorf("body_pattern: %w", err)
+	}
+	return nil
+}
+
+func (c *HealthCheckConfig) enabled() bool {
+	return c.Path != ""
+}
+
+func (c *HealthCheckConfig) interval() time.Duration {
+	if c.Interval <= 0 {
+		return time.Second * 10
+	}
+	return c.Interval
+}
+
+func (c *HealthCheckConfig) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return time.Second * 2
+	}
+	return c.Timeout
+}
+
+func (c *HealthCheckConfig) rise() int {
+	if c.Rise <= 0 {
+		return 2
+	}
+	return c.Rise
+}
+
+func (c *HealthCheckConfig) fall() int {
+	if c.Fall <= 0 {
+		return 3
+	}
+	return c.Fall
+}
+
+func (c *HealthCheckConfig) expectedStatus(status int) bool {
+	if len(c.ExpectedStatuses) == 0 {
+		return status >= 200 && status < 300
+	}
+	for _, expected := range c.ExpectedStatuses {
+		if status == expected {
+			return true
+		}
+	}
+	return false
+}
+
+// healthChecker checks target by interval, target is healthy until fall checks are failed
+type healthChecker struct {
+	config       *HealthCheckConfig
+	roundTripper http.RoundTripper
+	scheme       string
+	// group is name of upstream group (site, behavior), the same host could be checked by several groups
+	group       string
+	bodyPattern *regexp.Regexp
+
+	m         sync.Mutex
+	target    *target
+	successes int
+	failures  int
+	lastCheck time.Time
+	lastError string
+}
+
+func newHealthChecker(config *HealthCheckConfig, roundTripper http.RoundTripper, scheme string, group string, t *target) *healthChecker {
+	checker := &healthChecker{config: config, roundTripper: roundTripper, scheme: scheme, group: group, target: t}
+	if config.BodyPattern != "" {
+		checker.bodyPattern = regexp.MustCompile(config.BodyPattern)
+	}
+	return checker
+}
+
+func (c *healthChecker) run() {
+	metrics.UpstreamHealthy.WithLabelValues(c.target.host, c.group).Set(1)
+	ticker := time.NewTicker(c.config.interval())
+	defer ticker.Stop()
+	c.record(c.check())
+	for range ticker.C {
+		c.record(c.check())
+	}
+}
+
+func (c *healthChecker) check() error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.timeout())
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, c.scheme+"://"+c.target.host+c.config.Path, nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("User-Agent", "simple_cdn health check")
+	response, err := c.roundTripper.RoundTrip(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if !c.config.expectedStatus(response.StatusCode) {
+		return fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+	if c.bodyPattern == nil {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(response.Body, healthCheckBodyLimit))
+	if err != nil {
+		return err
+	}
+	if !c.bodyPattern.Match(body) {
+		return fmt.Errorf("body does not match pattern")
+	}
+	return nil
+}
+
+// record applies result of check, target state is changed after rise successes or fall failures in a row
+func (c *healthChecker) record(err error) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.lastCheck = time.Now()
+	log := logger.Logger().With(zap.String("component", "healthChecker")).With(zap.String("target", c.target.host))
+	if err == nil {
+		metrics.UpstreamHealthChecks.WithLabelValues(c.target.host, c.group, "success").Inc()
+		c.lastError = ""
+		c.failures = 0
+		c.successes++
+		if !c.target.healthy.Load() && c.successes >= c.config.rise() {
+			c.target.healthy.Store(true)
+			metrics.UpstreamHealthy.WithLabelValues(c.target.host, c.group).Set(1)
+			log.Info("upstream target is healthy")
+		}
+		return
+	}
+	metrics.UpstreamHealthChecks.WithLabelValues(c.target.host, c.group, "failure").Inc()
+	c.lastError = err.Error()
+	c.successes = 0
+	c.failures++
+	if c.target.healthy.Load() && c.failures >= c.config.fall() {
+		c.target.healthy.Store(false)
+		metrics.UpstreamHealthy.WithLabelValues(c.target.host, c.group).Set(0)
+		log.With(zap.Error(err)).Warn("upstream target is unhealthy")
+	}
+}
+
+type TargetHealth struct {
+	Host         string     `json:"host"`
+	Healthy      bool       `json:"healthy"`
+	LastCheck    *time.Time `json:"last_check,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+	EjectedUntil *time.Time `json:"ejected_until,omitempty"`
+}
+
+func (t *target) health() TargetHealth {
+	health := TargetHealth{Host: t.host, Healthy: t.healthy.Load()}
+	if t.checker != nil {
+		t.checker.m.Lock()
+		if !t.checker.lastCheck.IsZero() {
+			lastCheck := t.checker.lastCheck
+			health.LastCheck = &lastCheck
+		}
+		health.LastError = t.checker.lastError
+		t.checker.m.Unlock()
+	}
+	if now := time.Now(); t.ejected(now) {
+		ejectedUntil := time.Unix(0, t.ejectedUntil.Load())
+		health.EjectedUntil = &ejectedUntil
+	}
+	return health
+}
+
+var groupTargets = struct {
+	m       sync.Mutex
+	targets []*target
+}{}
+
+func registerTargets(targets []*target) {
+	groupTargets.m.Lock()
+	defer groupTargets.m.Unlock()
+	groupTargets.targets = append(groupTargets.targets, targets...)
+}
+
+// startHealthChecker runs health checks of target in background
+func startHealthChecker(checker *healthChecker) {
+	checker.target.checker = checker
+	go checker.run()
+}
+
+// Health returns state of targets of upstream groups, host referenced by several groups (sites, routes) is listed once:
+// it is unhealthy if any of its targets is unhealthy, the latest check and ejection are shown
+func Health() []TargetHealth {
+	groupTargets.m.Lock()
+	targets := append([]*target{}, groupTargets.targets...)
+	groupTargets.m.Unlock()
+	byHost := map[string]int{}
+	result := make([]TargetHealth, 0, len(targets))
+	for _, t := range targets {
+		health := t.health()
+		if i, exists := byHost[health.Host]; exists {
+			result[i].merge(health)
+			continue
+		}
+		byHost[health.Host] = len(result)
+		result = append(result, health)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Host < result[j].Host
+	})
+	return result
+}
+
+// merge adds state of another target of the same host
+func (h *TargetHealth) merge(other TargetHealth) {
+	h.Healthy = h.Healthy && other.Healthy
+	if other.LastCheck != nil && (h.LastCheck == nil || other.LastCheck.After(*h.LastCheck)) {
+		h.LastCheck = other.LastCheck
+		h.LastError = other.LastError
+	}
+	if other.EjectedUntil != nil && (h.EjectedUntil == nil || other.EjectedUntil.After(*h.EjectedUntil)) {
+		h.EjectedUntil = other.EjectedUntil
+	}
+}
@@ -0,0 +1,136 @@
+package upstream
+
+import (
+	"errors"
+	"github.com/paragor/simple_cdn/pkg/logger"
+	"github.com/paragor/simple_cdn/pkg/metrics"
+	"go.uber.org/zap/zapcore"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+var once sync.Once
+
+func initMetricsAndLogs() {
+	once.Do(func() {
+		logger.Init("testing", zapcore.DebugLevel)
+		metrics.Init("testing")
+	})
+}
+
+func TestHealthChecker_record(t *testing.T) {
+	initMetricsAndLogs()
+	target := newTarget("host0", 1, hostUpstream("host0"))
+	checker := newHealthChecker(&HealthCheckConfig{Path: "/healthz", Rise: 2, Fall: 3}, nil, "http", "test", target)
+	failure := errors.New("connection refused")
+
+	steps := []struct {
+		err         error
+		wantHealthy bool
+	}{
+		{err: failure, wantHealthy: true},
+		{err: failure, wantHealthy: true},
+		{err: nil, wantHealthy: true},
+		{err: failure, wantHealthy: true},
+		{err: failure, wantHealthy: true},
+		{err: failure, wantHealthy: false},
+		{err: nil, wantHealthy: false},
+		{err: failure, wantHealthy: false},
+		{err: nil, wantHealthy: false},
+		{err: nil, wantHealthy: true},
+	}
+	for i, step := range steps {
+		checker.record(step.err)
+		if got := target.available(); got != step.wantHealthy {
+			t.Fatalf("step %d: available() = %v, want %v", i, got, step.wantHealthy)
+		}
+	}
+}
+
+func TestHealthChecker_check(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ok":
+			_, _ = w.Write([]byte(`{"status": "ok"}`))
+		case "/degraded":
+			_, _ = w.Write([]byte(`{"status": "degraded"}`))
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		config  *HealthCheckConfig
+		wantErr bool
+	}{
+		{name: "2xx", config: &HealthCheckConfig{Path: "/ok"}, wantErr: false},
+		{name: "unexpected status", config: &HealthCheckConfig{Path: "/down"}, wantErr: true},
+		{name: "expected statuses", config: &HealthCheckConfig{Path: "/down", ExpectedStatuses: []int{503}}, wantErr: false},
+		{name: "body pattern", config: &HealthCheckConfig{Path: "/ok", BodyPattern: `"status": "ok"`}, wantErr: false},
+		{name: "body pattern mismatch", config: &HealthCheckConfig{Path: "/degraded", BodyPattern: `"status": "ok"`}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := newTarget(strings.TrimPrefix(server.URL, "http://"), 1, nil)
+			checker := newHealthChecker(tt.config, http.DefaultTransport, "http", "test", target)
+			if err := checker.check(); (err != nil) != tt.wantErr {
+				t.Errorf("check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestGroupUpstream_Do_noHealthyTargets(t *testing.T) {
+	for balancing := range balancers {
+		t.Run(balancing, func(t *testing.T) {
+			targets := createTargets(1, 1)
+			group := newGroupUpstream(targets, balancing, nil, nil)
+			targets[0].healthy.Store(false)
+			for i := 0; i < 10; i++ {
+				response, err := group.Do(httptest.NewRequest(http.MethodGet, "/"+strings.Repeat("a", i), nil))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if body := readBody(response); body != "host1" {
+					t.Errorf("response of %s, want host1", body)
+				}
+			}
+			targets[1].healthy.Store(false)
+			if _, err := group.Do(httptest.NewRequest(http.MethodGet, "/", nil)); !errors.Is(err, ErrNoHealthyTargets) {
+				t.Errorf("Do() error = %v, want %v", err, ErrNoHealthyTargets)
+			}
+		})
+	}
+}
+
+func readBody(response *http.Response) string {
+	defer response.Body.Close()
+	body, _ := io.ReadAll(response.Body)
+	return string(body)
+}
+
+func TestHealth_sharedHost(t *testing.T) {
+	first := newTarget("shared.health.test", 1, nil)
+	second := newTarget("shared.health.test", 1, nil)
+	second.healthy.Store(false)
+	newGroupUpstream([]*target{first}, BalancingRoundRobin, nil, nil)
+	newGroupUpstream([]*target{second}, BalancingRoundRobin, nil, nil)
+	found := []TargetHealth{}
+	for _, health := range Health() {
+		if health.Host == "shared.health.test" {
+			found = append(found, health)
+		}
+	}
+	if len(found) != 1 {
+		t.Fatalf("host is listed %d times, want 1", len(found))
+	}
+	if found[0].Healthy {
+		t.Errorf("host is healthy, want unhealthy as one of its targets")
+	}
+}
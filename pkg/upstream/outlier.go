@@ -0,0 +1,155 @@
+package upstream
+
+import (
+	"fmt"
+	"github.com/paragor/simple_cdn/pkg/logger"
+	"github.com/paragor/simple_cdn/pkg/metrics"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+const (
+	outlierReason5xx   = "5xx"
+	outlierReasonError = "error"
+)
+
+// OutlierDetectionConfig ejects targets by real traffic, detection is disabled if both thresholds are 0
+type OutlierDetectionConfig struct {
+	// Consecutive5xx - count of 5xx responses in a row to eject target
+	Consecutive5xx int `yaml:"consecutive_5xx"`
+	// ConsecutiveErrors - count of connection errors and timeouts in a row to eject target
+	ConsecutiveErrors int `yaml:"consecutive_errors"`
+	// BaseEjectionTime - ejection time is doubled on each ejection in a row up to MaxEjectionTime
+	BaseEjectionTime time.Duration `yaml:"base_ejection_time"`
+	MaxEjectionTime  time.Duration `yaml:"max_ejection_time"`
+	// MaxEjectionPercent - max share of ejected targets, at least one target could be ejected,
+	// but the last available target is never ejected
+	MaxEjectionPercent int `yaml:"max_ejection_percent"`
+}
+
+func (c *OutlierDetectionConfig) Validate() error {
+	if c.Consecutive5xx < 0 {
+		return fmt.Errorf("consecutive_5xx should be >= 0")
+	}
+	if c.ConsecutiveErrors < 0 {
+		return fmt.Errorf("consecutive_errors should be >= 0")
+	}
+	if c.BaseEjectionTime < 0 {
+		return fmt.Errorf("base_ejection_time should be >= 0")
+	}
+	if c.MaxEjectionTime < 0 {
+		return fmt.Errorf("max_ejection_time should be >= 0")
+	}
+	if c.MaxEjectionPercent < 0 || c.MaxEjectionPercent > 100 {
+		return fmt.Errorf("max_ejection_percent should be in [0, 100]")
+	}
+	return nil
+}
+
+func (c *OutlierDetectionConfig) enabled() bool {
+	return c.Consecutive5xx > 0 || c.ConsecutiveErrors > 0
+}
+
+func (c *OutlierDetectionConfig) baseEjectionTime() time.Duration {
+	if c.BaseEjectionTime <= 0 {
+		return time.Second * 30
+	}
+	return c.BaseEjectionTime
+}
+
+func (c *OutlierDetectionConfig) maxEjectionTime() time.Duration {
+	if c.MaxEjectionTime <= 0 {
+		return time.Minute * 5
+	}
+	return max(c.MaxEjectionTime, c.baseEjectionTime())
+}
+
+func (c *OutlierDetectionConfig) maxEjectionPercent() int {
+	if c.MaxEjectionPercent <= 0 {
+		return 50
+	}
+	return c.MaxEjectionPercent
+}
+
+// outlierDetector counts failures of targets in a row and ejects them
+type outlierDetector struct {
+	config  *OutlierDetectionConfig
+	targets []*target
+	now     func() time.Time
+
+	m sync.Mutex
+}
+
+func newOutlierDetector(config *OutlierDetectionConfig, targets []*target) *outlierDetector {
+	return &outlierDetector{config: config, targets: targets, now: time.Now}
+}
+
+// record applies result of request to target, err is connection error or timeout
+func (d *outlierDetector) record(t *target, status int, err error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	switch {
+	case err != nil:
+		t.consecutive5xx = 0
+		t.consecutiveErrors++
+		if d.config.ConsecutiveErrors > 0 && t.consecutiveErrors >= d.config.ConsecutiveErrors {
+			d.eject(t, outlierReasonError)
+		}
+	case status >= 500:
+		t.consecutiveErrors = 0
+		t.consecutive5xx++
+		if d.config.Consecutive5xx > 0 && t.consecutive5xx >= d.config.Consecutive5xx {
+			d.eject(t, outlierReason5xx)
+		}
+	default:
+		t.consecutiveErrors = 0
+		t.consecutive5xx = 0
+	}
+}
+
+// eject removes target from rotation, ejection time grows exponentially while target is ejected again
+// within max ejection time after previous ejection
+func (d *outlierDetector) eject(t *target, reason string) {
+	now := d.now()
+	if t.ejected(now) {
+		return
+	}
+	ejected := 0
+	availableOthers := 0
+	for _, other := range d.targets {
+		if other.ejected(now) {
+			ejected++
+		} else if other != t && other.healthy.Load() {
+			availableOthers++
+		}
+	}
+	// last available target is never ejected (panic mode), requests to it are better than no requests at all
+	if availableOthers == 0 {
+		metrics.UpstreamEjections.WithLabelValues(t.host, "skipped_last_available").Inc()
+		return
+	}
+	if ejected > 0 && (ejected+1)*100 > d.config.maxEjectionPercent()*len(d.targets) {
+		metrics.UpstreamEjections.WithLabelValues(t.host, "skipped_max_ejection_percent").Inc()
+		return
+	}
+	if previous := t.ejectedUntil.Load(); previous == 0 || now.Sub(time.Unix(0, previous)) > d.config.maxEjectionTime() {
+		t.ejections = 0
+	}
+	ejectionTime := d.config.baseEjectionTime()
+	for i := 0; i < t.ejections && ejectionTime < d.config.maxEjectionTime(); i++ {
+		ejectionTime *= 2
+	}
+	ejectionTime = min(ejectionTime, d.config.maxEjectionTime())
+	t.ejections++
+	t.ejectedUntil.Store(now.Add(ejectionTime).UnixNano())
+	t.consecutiveErrors = 0
+	t.consecutive5xx = 0
+	metrics.UpstreamEjections.WithLabelValues(t.host, reason).Inc()
+	logger.Logger().
+		With(zap.String("component", "outlierDetector")).
+		With(zap.String("target", t.host)).
+		With(zap.String("reason", reason)).
+		With(zap.Duration("ejection_time", ejectionTime)).
+		Warn("upstream target is ejected")
+}
@@ -0,0 +1,98 @@
+package upstream
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestOutlierDetector_record(t *testing.T) {
+	initMetricsAndLogs()
+	targets := createTargets(1, 1, 1, 1)
+	now := time.Now()
+	detector := newOutlierDetector(&OutlierDetectionConfig{
+		Consecutive5xx:     3,
+		ConsecutiveErrors:  2,
+		BaseEjectionTime:   time.Second * 10,
+		MaxEjectionTime:    time.Second * 30,
+		MaxEjectionPercent: 50,
+	}, targets)
+	detector.now = func() time.Time { return now }
+	failure := errors.New("request timeout")
+
+	// success resets counter
+	detector.record(targets[0], 500, nil)
+	detector.record(targets[0], 500, nil)
+	detector.record(targets[0], 200, nil)
+	detector.record(targets[0], 500, nil)
+	if targets[0].ejected(now) {
+		t.Fatalf("target is ejected after 5xx with success between")
+	}
+	detector.record(targets[0], 502, nil)
+	detector.record(targets[0], 503, nil)
+	if !targets[0].ejected(now) || targets[0].ejected(now.Add(time.Second*10)) {
+		t.Fatalf("target should be ejected for base ejection time")
+	}
+
+	detector.record(targets[1], 0, failure)
+	detector.record(targets[1], 0, failure)
+	if !targets[1].ejected(now) {
+		t.Fatalf("target should be ejected after errors")
+	}
+
+	// 2 of 4 targets are ejected, it is max percent
+	detector.record(targets[2], 0, failure)
+	detector.record(targets[2], 0, failure)
+	if targets[2].ejected(now) {
+		t.Fatalf("target is ejected over max ejection percent")
+	}
+
+	// ejection time is doubled on ejection after previous one
+	now = now.Add(time.Second * 11)
+	detector.record(targets[0], 0, failure)
+	detector.record(targets[0], 0, failure)
+	if !targets[0].ejected(now.Add(time.Second*19)) || targets[0].ejected(now.Add(time.Second*20)) {
+		t.Fatalf("target should be ejected for doubled ejection time")
+	}
+	now = now.Add(time.Second * 21)
+	detector.record(targets[0], 0, failure)
+	detector.record(targets[0], 0, failure)
+	if !targets[0].ejected(now.Add(time.Second*29)) || targets[0].ejected(now.Add(time.Second*30)) {
+		t.Fatalf("ejection time should be limited by max ejection time")
+	}
+
+	// ejections are forgotten after max ejection time without ejection
+	now = now.Add(time.Minute * 2)
+	detector.record(targets[0], 0, failure)
+	detector.record(targets[0], 0, failure)
+	if !targets[0].ejected(now) || targets[0].ejected(now.Add(time.Second*10)) {
+		t.Fatalf("target should be ejected for base ejection time")
+	}
+}
+
+func TestOutlierDetector_lastAvailableTarget(t *testing.T) {
+	initMetricsAndLogs()
+	single := createTargets(1)
+	detector := newOutlierDetector(&OutlierDetectionConfig{Consecutive5xx: 1}, single)
+	detector.record(single[0], 500, nil)
+	if !single[0].available() {
+		t.Fatalf("single target is ejected")
+	}
+
+	targets := createTargets(1, 1)
+	detector = newOutlierDetector(&OutlierDetectionConfig{Consecutive5xx: 1, MaxEjectionPercent: 100}, targets)
+	targets[1].healthy.Store(false)
+	detector.record(targets[0], 500, nil)
+	if !targets[0].available() {
+		t.Fatalf("last healthy target is ejected")
+	}
+	targets[1].healthy.Store(true)
+	detector.record(targets[0], 500, nil)
+	if targets[0].available() {
+		t.Fatalf("target should be ejected while another one is available")
+	}
+	detector.record(targets[1], 500, nil)
+	if !targets[1].available() {
+		t.Fatalf("last not ejected target is ejected")
+	}
+}
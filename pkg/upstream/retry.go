@@ -0,0 +1,220 @@
+package upstream
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/paragor/simple_cdn/pkg/logger"
+	"github.com/paragor/simple_cdn/pkg/metrics"
+	"go.uber.org/zap"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// retryBudgetMaxBalance is max count of retries which could be made in a row without new requests
+const retryBudgetMaxBalance = 10.0
+
+// idempotentMethods could be retried (rfc9110 section 9.2.2)
+var idempotentMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete,
+}
+
+// RetryConfig - retries of idempotent requests, retries are disabled if attempts is 0
+type RetryConfig struct {
+	// Attempts - max count of retries of request
+	Attempts int `yaml:"attempts"`
+	// Statuses - statuses of response which are retried, default is 502, 503 and 504
+	Statuses []int `yaml:"statuses,omitempty"`
+	// BaseBackoff - delay before retry is doubled on each retry up to MaxBackoff, jitter is added to delay
+	BaseBackoff time.Duration `yaml:"base_backoff"`
+	MaxBackoff  time.Duration `yaml:"max_backoff"`
+	// BudgetPercent - max share of retries to requests, so retries never amplify an outage
+	BudgetPercent float64 `yaml:"budget_percent"`
+	// MaxBodySize - requests with bigger body are not retried
+	MaxBodySize int64 `yaml:"max_body_size"`
+}
+
+func (c *RetryConfig) Validate() error {
+	if c.Attempts < 0 {
+		return fmt.Errorf("attempts should be >= 0")
+	}
+	for _, status := range c.Statuses {
+		if status < 100 || status > 599 {
+			return fmt.Errorf("statuses: invalid status %d", status)
+		}
+	}
+	if c.BaseBackoff < 0 {
+		return fmt.Errorf("base_backoff should be >= 0")
+	}
+	if c.MaxBackoff < 0 {
+		return fmt.Errorf("max_backoff should be >= 0")
+	}
+	if c.BudgetPercent < 0 || c.BudgetPercent > 100 {
+		return fmt.Errorf("budget_percent should be in [0, 100]")
+	}
+	if c.MaxBodySize < 0 {
+		return fmt.Errorf("max_body_size should be >= 0")
+	}
+	return nil
+}
+
+func (c *RetryConfig) enabled() bool {
+	return c.Attempts > 0
+}
+
+func (c *RetryConfig) statuses() []int {
+	if len(c.Statuses) == 0 {
+		return []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	}
+	return c.Statuses
+}
+
+func (c *RetryConfig) baseBackoff() time.Duration {
+	if c.BaseBackoff <= 0 {
+		return time.Millisecond * 25
+	}
+	return c.BaseBackoff
+}
+
+func (c *RetryConfig) maxBackoff() time.Duration {
+	if c.MaxBackoff <= 0 {
+		return time.Millisecond * 250
+	}
+	return max(c.MaxBackoff, c.baseBackoff())
+}
+
+func (c *RetryConfig) budgetPercent() float64 {
+	if c.BudgetPercent <= 0 {
+		return 10
+	}
+	return c.BudgetPercent
+}
+
+func (c *RetryConfig) maxBodySize() int64 {
+	if c.MaxBodySize <= 0 {
+		return 64 * 1024
+	}
+	return c.MaxBodySize
+}
+
+// backoff returns delay before retry (from 0) with equal jitter
+func (c *RetryConfig) backoff(retry int) time.Duration {
+	backoff := c.baseBackoff()
+	for i := 0; i < retry && backoff < c.maxBackoff(); i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, c.maxBackoff())
+	return backoff/2 + rand.N(backoff/2+1)
+}
+
+// retryable returns true if request could be replayed
+func (c *RetryConfig) retryable(r *http.Request) bool {
+	return slices.Contains(idempotentMethods, r.Method)
+}
+
+// retryBudget allows retries while they are not more than percent of requests
+type retryBudget struct {
+	m       sync.Mutex
+	ratio   float64
+	balance float64
+}
+
+func newRetryBudget(percent float64) *retryBudget {
+	return &retryBudget{ratio: percent / 100, balance: retryBudgetMaxBalance}
+}
+
+// deposit is called on every request
+func (b *retryBudget) deposit() {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.balance = min(b.balance+b.ratio, retryBudgetMaxBalance)
+}
+
+// withdraw returns true if retry is allowed
+func (b *retryBudget) withdraw() bool {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.balance < 1 {
+		return false
+	}
+	b.balance--
+	return true
+}
+
+// doWithRetries retries request on error or retry status, every retry goes to another target if possible
+func (g *groupUpstream) doWithRetries(originRequest *http.Request) (*http.Response, error) {
+	g.budget.deposit()
+	body, replayable, err := bufferBody(originRequest, g.retry.maxBodySize())
+	if err != nil {
+		return nil, err
+	}
+	if !replayable {
+		// body is too big to keep it in memory, so request has only one attempt
+		request := originRequest.Clone(originRequest.Context())
+		request.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), originRequest.Body))
+		_, response, err := g.try(request, nil)
+		return response, err
+	}
+	log := logger.FromCtx(originRequest.Context()).With(zap.String("component", "retryUpstream"))
+	tried := []*target{}
+	for retry := 0; ; retry++ {
+		request := originRequest.Clone(originRequest.Context())
+		request.Body = io.NopCloser(bytes.NewReader(body))
+		request.ContentLength = int64(len(body))
+		chosen, response, err := g.try(request, tried)
+		reason := ""
+		switch {
+		case errors.Is(err, ErrNoHealthyTargets):
+			return response, err
+		case err != nil:
+			reason = "error"
+		case slices.Contains(g.retry.statuses(), response.StatusCode):
+			reason = "status"
+		default:
+			return response, nil
+		}
+		if retry >= g.retry.Attempts {
+			return response, err
+		}
+		if !g.budget.withdraw() {
+			metrics.UpstreamRetries.WithLabelValues("budget_exhausted").Inc()
+			return response, err
+		}
+		metrics.UpstreamRetries.WithLabelValues(reason).Inc()
+		log.With(zap.String("target", chosen.host)).With(zap.String("reason", reason)).With(zap.Int("retry", retry+1)).
+			Warn("retry upstream request")
+		if response != nil {
+			_, _ = io.Copy(io.Discard, response.Body)
+			_ = response.Body.Close()
+		}
+		tried = append(tried, chosen)
+
+		timer := time.NewTimer(g.retry.backoff(retry))
+		select {
+		case <-timer.C:
+		case <-originRequest.Context().Done():
+			timer.Stop()
+			return nil, originRequest.Context().Err()
+		}
+	}
+}
+
+// bufferBody reads body for replays, replayable is false if body is bigger than limit,
+// in that case the rest of body is not read
+func bufferBody(r *http.Request, limit int64) (body []byte, replayable bool, err error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true, nil
+	}
+	if r.ContentLength > limit {
+		return nil, false, nil
+	}
+	body, err = io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	return body, int64(len(body)) <= limit, nil
+}
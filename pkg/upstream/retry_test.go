@@ -0,0 +1,171 @@
+package upstream
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func createRetryGroup(retry *RetryConfig, upstreams ...*statusUpstream) Upstream {
+	targets := make([]*target, 0, len(upstreams))
+	for i, u := range upstreams {
+		targets = append(targets, newTarget("host"+strconv.Itoa(i), 1, u))
+	}
+	return newGroupUpstream(targets, BalancingRoundRobin, nil, retry)
+}
+
+func TestGroupUpstream_Do_retry(t *testing.T) {
+	initMetricsAndLogs()
+	failure := errors.New("connection reset by peer")
+	retry := &RetryConfig{Attempts: 2, BaseBackoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	tests := []struct {
+		name         string
+		method       string
+		body         string
+		retry        *RetryConfig
+		upstreams    []*statusUpstream
+		wantStatus   int
+		wantErr      bool
+		wantRequests []int
+	}{
+		{
+			name:         "ok",
+			method:       http.MethodGet,
+			retry:        retry,
+			upstreams:    []*statusUpstream{{status: 200}, {status: 200}},
+			wantStatus:   200,
+			wantRequests: []int{1, 0},
+		},
+		{
+			name:         "retry on status goes to another target",
+			method:       http.MethodGet,
+			retry:        retry,
+			upstreams:    []*statusUpstream{{status: 503}, {status: 200}},
+			wantStatus:   200,
+			wantRequests: []int{1, 1},
+		},
+		{
+			name:         "retry on error with body",
+			method:       http.MethodPut,
+			body:         "payload",
+			retry:        retry,
+			upstreams:    []*statusUpstream{{err: failure}, {status: 200}},
+			wantStatus:   200,
+			wantRequests: []int{1, 1},
+		},
+		{
+			name:         "single target is retried",
+			method:       http.MethodGet,
+			retry:        retry,
+			upstreams:    []*statusUpstream{{status: 502}},
+			wantStatus:   502,
+			wantRequests: []int{3},
+		},
+		{
+			name:         "attempts are limited",
+			method:       http.MethodGet,
+			retry:        retry,
+			upstreams:    []*statusUpstream{{err: failure}, {err: failure}},
+			wantErr:      true,
+			wantRequests: []int{1, 2},
+		},
+		{
+			name:         "not retry status",
+			method:       http.MethodGet,
+			retry:        retry,
+			upstreams:    []*statusUpstream{{status: 500}, {status: 200}},
+			wantStatus:   500,
+			wantRequests: []int{1, 0},
+		},
+		{
+			name:         "not idempotent method",
+			method:       http.MethodPost,
+			body:         "payload",
+			retry:        retry,
+			upstreams:    []*statusUpstream{{status: 503}, {status: 200}},
+			wantStatus:   503,
+			wantRequests: []int{1, 0},
+		},
+		{
+			name:         "body is too big",
+			method:       http.MethodPut,
+			body:         "payload",
+			retry:        &RetryConfig{Attempts: 2, MaxBodySize: 3},
+			upstreams:    []*statusUpstream{{status: 503}, {status: 200}},
+			wantStatus:   503,
+			wantRequests: []int{1, 0},
+		},
+		{
+			name:         "retries are disabled",
+			method:       http.MethodGet,
+			retry:        &RetryConfig{},
+			upstreams:    []*statusUpstream{{status: 503}, {status: 200}},
+			wantStatus:   503,
+			wantRequests: []int{1, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			group := createRetryGroup(tt.retry, tt.upstreams...)
+			response, err := group.Do(httptest.NewRequest(tt.method, "/", strings.NewReader(tt.body)))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Do() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && response.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", response.StatusCode, tt.wantStatus)
+			}
+			for i, u := range tt.upstreams {
+				if len(u.bodies) != tt.wantRequests[i] {
+					t.Errorf("upstream %d got %d requests, want %d", i, len(u.bodies), tt.wantRequests[i])
+				}
+				for _, body := range u.bodies {
+					if body != tt.body {
+						t.Errorf("upstream %d got body %q, want %q", i, body, tt.body)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestGroupUpstream_Do_retryBudget(t *testing.T) {
+	initMetricsAndLogs()
+	failing := &statusUpstream{status: 503}
+	group := createRetryGroup(&RetryConfig{Attempts: 1, BaseBackoff: time.Millisecond, BudgetPercent: 10}, failing)
+	for i := 0; i < 1000; i++ {
+		response, err := group.Do(httptest.NewRequest(http.MethodGet, "/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = response.Body.Close()
+	}
+	// 10 retries of initial balance and 10% of requests
+	if retries := len(failing.bodies) - 1000; retries < 100 || retries > 110 {
+		t.Errorf("retries = %d, want about 10%% of requests", retries)
+	}
+}
+
+func TestRetryConfig_backoff(t *testing.T) {
+	config := &RetryConfig{BaseBackoff: time.Millisecond * 10, MaxBackoff: time.Millisecond * 50}
+	tests := []struct {
+		retry   int
+		wantMin time.Duration
+		wantMax time.Duration
+	}{
+		{retry: 0, wantMin: time.Millisecond * 5, wantMax: time.Millisecond * 10},
+		{retry: 1, wantMin: time.Millisecond * 10, wantMax: time.Millisecond * 20},
+		{retry: 2, wantMin: time.Millisecond * 20, wantMax: time.Millisecond * 40},
+		{retry: 10, wantMin: time.Millisecond * 25, wantMax: time.Millisecond * 50},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			if got := config.backoff(tt.retry); got < tt.wantMin || got > tt.wantMax {
+				t.Fatalf("backoff(%d) = %v, want in [%v, %v]", tt.retry, got, tt.wantMin, tt.wantMax)
+			}
+		}
+	}
+}
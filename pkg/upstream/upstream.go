@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"github.com/paragor/simple_cdn/pkg/pathnorm"
 	"github.com/paragor/simple_cdn/pkg/utils/pool"
 	"io"
 	"net/http"
+	"strconv"
 	"time"
 )
 
@@ -15,12 +17,67 @@ type Config struct {
 	Host                string              `yaml:"host"`
 	Scheme              string              `yaml:"scheme"`
 	RequestTimeout      time.Duration       `yaml:"request_timeout"`
+	// Targets - group of origin servers, only one of host and targets must be specified
+	Targets []TargetConfig `yaml:"targets,omitempty"`
+	// Balancing - strategy of choosing target: round_robin (default), least_outstanding, random_two_choices, consistent_hash
+	Balancing string `yaml:"balancing"`
+	// HealthCheck - active health checks of targets (or host), unhealthy targets are removed from rotation
+	HealthCheck HealthCheckConfig `yaml:"health_check"`
+	// OutlierDetection - targets with failures in a row are ejected from rotation for a while
+	OutlierDetection OutlierDetectionConfig `yaml:"outlier_detection"`
+	// Failover - ordered secondary upstreams, request goes to the next one on error or failover status of previous
+	Failover []Config `yaml:"failover,omitempty"`
+	// FailoverStatuses - statuses of response which cause failover, default is 502, 503 and 504
+	FailoverStatuses []int `yaml:"failover_statuses,omitempty"`
+	// FailoverMaxBodySize - requests with bigger body do not fail over, default is 64KiB
+	FailoverMaxBodySize int64 `yaml:"failover_max_body_size"`
+	// Retry - retries of idempotent requests on errors and retry statuses, retry goes to another target if possible
+	Retry RetryConfig `yaml:"retry"`
 }
 
 func (c *Config) Validate() error {
-	if c.Host == "" {
+	if c.Host == "" && len(c.Targets) == 0 {
 		return fmt.Errorf("host can not be empty")
 	}
+	if c.Host != "" && len(c.Targets) > 0 {
+		return fmt.Errorf("only on of two field must be specified: host, targets")
+	}
+	for i, target := range c.Targets {
+		if err := target.Validate(); err != nil {
+			return fmt.Errorf("targets: %d invalid: %w", i, err)
+		}
+	}
+	if err := c.HealthCheck.Validate(); err != nil {
+		return fmt.Errorf("health_check invalid: %w", err)
+	}
+	if err := c.OutlierDetection.Validate(); err != nil {
+		return fmt.Errorf("outlier_detection invalid: %w", err)
+	}
+	if err := c.Retry.Validate(); err != nil {
+		return fmt.Errorf("retry invalid: %w", err)
+	}
+	for i := range c.Failover {
+		if len(c.Failover[i].Failover) > 0 {
+			return fmt.Errorf("failover: %d invalid: failover of failover upstream is not supported", i)
+		}
+		if err := c.Failover[i].Validate(); err != nil {
+			return fmt.Errorf("failover: %d invalid: %w", i, err)
+		}
+	}
+	for _, status := range c.FailoverStatuses {
+		if status < 100 || status > 599 {
+			return fmt.Errorf("failover_statuses: invalid status %d", status)
+		}
+	}
+	if c.FailoverMaxBodySize < 0 {
+		return fmt.Errorf("failover_max_body_size should be >= 0")
+	}
+	if _, ok := balancers[c.Balancing]; c.Balancing != "" && !ok {
+		return fmt.Errorf(
+			"balancing should have value %s, %s, %s or %s",
+			BalancingRoundRobin, BalancingLeastOutstanding, BalancingRandomTwoChoices, BalancingConsistentHash,
+		)
+	}
 	if c.Scheme != "http" && c.Scheme != "https" {
 		return fmt.Errorf("scheme should have value http or https")
 	}
@@ -30,18 +87,61 @@ func (c *Config) Validate() error {
 	return c.TransportPoolConfig.Validate()
 }
 
-func (c *Config) CreateUpstream() Upstream {
+// CreateUpstream returns upstream, group is name of upstream in metrics (e.g. site or behavior)
+func (c *Config) CreateUpstream(group string) Upstream {
+	if len(c.Failover) == 0 {
+		return c.createUpstream(group)
+	}
+	upstreams := []Upstream{c.createUpstream(group)}
+	for i := range c.Failover {
+		upstreams = append(upstreams, c.Failover[i].createUpstream(group+"/failover/"+strconv.Itoa(i+1)))
+	}
+	return newFailoverUpstream(upstreams, c.failoverStatuses(), c.failoverMaxBodySize())
+}
+
+func (c *Config) failoverStatuses() []int {
+	if len(c.FailoverStatuses) == 0 {
+		return []int{http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+	}
+	return c.FailoverStatuses
+}
+
+func (c *Config) failoverMaxBodySize() int64 {
+	if c.FailoverMaxBodySize <= 0 {
+		return 64 * 1024
+	}
+	return c.FailoverMaxBodySize
+}
+
+func (c *Config) createUpstream(group string) Upstream {
 	requestTimeout := c.RequestTimeout
 	if requestTimeout <= 0 {
 		requestTimeout = time.Second * 360
 	}
 
-	return newSingleHostUpstream(
-		NewTransportPool(c.TransportPoolConfig),
-		requestTimeout,
-		c.Scheme,
-		c.Host,
-	)
+	transportPool := NewTransportPool(c.TransportPoolConfig)
+	if len(c.Targets) == 0 && !c.HealthCheck.enabled() && !c.OutlierDetection.enabled() && !c.Retry.enabled() {
+		return newSingleHostUpstream(
+			transportPool,
+			requestTimeout,
+			c.Scheme,
+			c.Host,
+		)
+	}
+	targetConfigs := c.Targets
+	if len(targetConfigs) == 0 {
+		// single host is group of one target, so it could be health checked, ejected and retried
+		targetConfigs = []TargetConfig{{Host: c.Host}}
+	}
+	targets := make([]*target, 0, len(targetConfigs))
+	for _, targetConfig := range targetConfigs {
+		t := newTarget(targetConfig.Host, targetConfig.weight(), newSingleHostUpstream(transportPool, requestTimeout, c.Scheme, targetConfig.Host))
+		if c.HealthCheck.enabled() {
+			startHealthChecker(newHealthChecker(&c.HealthCheck, transportPool, c.Scheme, group, t))
+		}
+		targets = append(targets, t)
+	}
+	return newGroupUpstream(targets, c.Balancing, &c.OutlierDetection, &c.Retry)
 }
 
 type Upstream interface {
@@ -82,6 +182,10 @@ func (u *singleHostUpstream) Do(originRequest *http.Request) (*http.Response, er
 	request.URL.Scheme = u.targetScheme
 	request.URL.Host = u.targetHost
 	request.Host = u.targetHost
+	if path, rawPath, ok := pathnorm.UpstreamPath(originRequest.Context()); ok {
+		request.URL.Path = path
+		request.URL.RawPath = rawPath
+	}
 	if requestBody.Len() == 0 {
 		request.Body = nil
 	} else {
@@ -0,0 +1,14 @@
+package hostnorm
+
+import (
+	"net"
+	"strings"
+)
+
+// Normalize returns lowercase host of Host header without port and trailing dot
+func Normalize(host string) string {
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		host = hostname
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
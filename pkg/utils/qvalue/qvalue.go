@@ -0,0 +1,54 @@
+package qvalue
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Value is element of header like Accept-Encoding or Accept-Language with its q-value
+type Value struct {
+	Value   string
+	Quality float64
+}
+
+// Parse returns lowercase values of header in order of header, q-value is 1 if it is not specified and 0 if it is invalid
+func Parse(header string) []Value {
+	values := []Value{}
+	for _, part := range strings.Split(header, ",") {
+		value, params, _ := strings.Cut(part, ";")
+		value = strings.ToLower(strings.TrimSpace(value))
+		if value == "" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, q, _ := strings.Cut(param, "=")
+			if strings.ToLower(strings.TrimSpace(name)) != "q" {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(q), 64)
+			if err != nil {
+				parsed = 0
+			}
+			quality = parsed
+		}
+		values = append(values, Value{Value: value, Quality: quality})
+	}
+	return values
+}
+
+// Preferred returns lowercase values of header ordered by q-values, values with q=0 are skipped
+func Preferred(header string) []string {
+	values := Parse(header)
+	sort.SliceStable(values, func(i, j int) bool {
+		return values[i].Quality > values[j].Quality
+	})
+	result := make([]string, 0, len(values))
+	for _, value := range values {
+		if value.Quality > 0 {
+			result = append(result, value.Value)
+		}
+	}
+	return result
+}